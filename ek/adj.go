@@ -0,0 +1,257 @@
+// Copyright 2013 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Unmarshal XML Adustemnet data
+
+package ek
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	MAX_ORDER      = 9    //Highest polynomial order accepted
+	MAX_GAIN_ERROR = 0.05 //Order 1 coefficient must be within 1 +- this
+)
+
+type Coefficient struct {
+	Order int     `xml:"Order,attr"`
+	Value float64 `xml:",chardata"`
+}
+
+type ChannelAdjustment struct {
+	Channel     int     `xml:"Channel,attr"`
+	Range       float64 `xml:"MeasuringRange,attr"`
+	Type        string  `xml:"Type,attr"` //Empty for analog inputs, AnalogOutput or CurrentSource
+	Coefficient []Coefficient
+}
+
+type Adjustment struct {
+	Version  string `xml:"Version,attr"`
+	Date     string `xml:"Date,attr"`
+	Hardware string `xml:"Hardware,attr"`
+	Software string `xml:"Software,attr"`
+	Person   string `xml:"Person,attr"`
+	User     string `xml:"User,attr"`
+	Location string `xml:"Location,attr"`
+	Data     []ChannelAdjustment
+}
+
+type Calibration struct {
+	XMLName     xml.Name `xml:"Default"`
+	Calibration string   //Base64 encoded LZO1X compressed calibration certificate
+	Adjustment  Adjustment
+	Certificate *CalibrationCertificate `xml:"-"` //Decoded Calibration. nil if it could not be decoded
+}
+
+type AdjustmentTable struct {
+	Orders int
+	Order  []float64 //Coefficients as received, index is order
+	Scale  []float64 //Scaling for each order
+}
+
+//Coefficients indexed by order. Missing orders are 0, except order 1 which is 1.
+func (adj *ChannelAdjustment) Orders() []float64 {
+	n := 2
+	for _, coeff := range adj.Coefficient {
+		if coeff.Order+1 > n {
+			n = coeff.Order + 1
+		}
+	}
+	order := make([]float64, n)
+	order[1] = 1
+	for _, coeff := range adj.Coefficient {
+		order[coeff.Order] = coeff.Value
+	}
+	return order
+}
+
+//Adjustment of an analog input. Outputs and current sources have the same channel numbers.
+func (adj *ChannelAdjustment) Input() bool {
+	return adj.Type == ""
+}
+
+//Check that scale (per order, see DeviceProfile.CoefficientScale) covers
+//every order of the input adjustments for range r. nil scale is an unknown range.
+func (c *Calibration) ValidateScale(r float64, scale []float64) error {
+	if scale == nil {
+		return fmt.Errorf("calibration: no coefficient scaling known for range %g", r)
+	}
+	for _, adj := range c.Adjustment.Data {
+		if !adj.Input() || adj.Range != r {
+			continue
+		}
+		if n := len(adj.Orders()); n > len(scale) {
+			return fmt.Errorf("calibration: channel %d range %g has order %d, scaling known to order %d", adj.Channel, r, n-1, len(scale)-1)
+		}
+	}
+	return nil
+}
+
+//Return simple adjustment table for inputs in range r, coefficients scaled by scale
+func (c *Calibration) AdjustmentTable(r float64, scale []float64, adjt []AdjustmentTable) error {
+	if err := c.ValidateScale(r, scale); err != nil {
+		return err
+	}
+	for _, adj := range c.Adjustment.Data {
+		if adj.Input() && adj.Range == r {
+			order := adj.Orders()
+			adjt[adj.Channel] = AdjustmentTable{}
+			adjt[adj.Channel].Orders = len(order)
+			adjt[adj.Channel].Order = order
+			adjt[adj.Channel].Scale = scale[:len(order)]
+		}
+	}
+	return nil
+}
+
+// ADC Correction. Horner evaluation of the adjustment polynomial.
+func AdjustValue(v float64, adj AdjustmentTable) float64 {
+	if adj.Orders == 0 {
+		return v
+	}
+	out := float64(0)
+	for i := adj.Orders - 1; i >= 0; i-- {
+		out = out*v + adj.Order[i]*adj.Scale[i]
+	}
+	return out
+}
+
+//Derivative of the adjustment polynomial at v
+func adjustSlope(v float64, adj AdjustmentTable) float64 {
+	out := float64(0)
+	for i := adj.Orders - 1; i >= 1; i-- {
+		out = out*v + float64(i)*adj.Order[i]*adj.Scale[i]
+	}
+	return out
+}
+
+//Inverse of AdjustValue. Newton's method starting at v, the polynomial is close to identity.
+func UnadjustValue(v float64, adj AdjustmentTable) float64 {
+	if adj.Orders == 0 {
+		return v
+	}
+	x := v
+	for i := 0; i < 50; i++ {
+		slope := adjustSlope(x, adj)
+		if slope == 0 {
+			break
+		}
+		dx := (AdjustValue(x, adj) - v) / slope
+		x -= dx
+		if math.Abs(dx) <= 1e-12*math.Max(1, math.Abs(x)) {
+			break
+		}
+	}
+	return x
+}
+
+//Returns unmarshaled adjustment data
+func NewCalibration(b []byte) (*Calibration, error) {
+	adj := Calibration{}
+	err := xml.Unmarshal(b, &adj)
+	if err != nil {
+		return nil, err
+	}
+	if adj.Calibration != "" {
+		adj.Certificate, _ = NewCalibrationCertificate(adj.Calibration)
+	}
+	return &adj, nil
+}
+
+//Check that the adjustment data can be used for a unit with n channels
+func (c *Calibration) Validate(n int) error {
+	if len(c.Adjustment.Data) == 0 {
+		return fmt.Errorf("calibration: no adjustment data")
+	}
+	for _, adj := range c.Adjustment.Data {
+		if adj.Channel < 0 || adj.Channel >= n {
+			return fmt.Errorf("calibration: channel %d out of range (%d channels)", adj.Channel, n)
+		}
+		if len(adj.Coefficient) < 1 {
+			return fmt.Errorf("calibration: channel %d range %g has no coefficients", adj.Channel, adj.Range)
+		}
+		seen := make(map[int]bool)
+		for _, coeff := range adj.Coefficient {
+			if coeff.Order < 0 || coeff.Order > MAX_ORDER || seen[coeff.Order] {
+				return fmt.Errorf("calibration: channel %d range %g has bad coefficient order %d", adj.Channel, adj.Range, coeff.Order)
+			}
+			seen[coeff.Order] = true
+			if math.IsNaN(coeff.Value) || math.IsInf(coeff.Value, 0) {
+				return fmt.Errorf("calibration: channel %d range %g has invalid coefficient %g", adj.Channel, adj.Range, coeff.Value)
+			}
+		}
+		if gain := adj.Orders()[1]; math.Abs(gain-1) > MAX_GAIN_ERROR {
+			return fmt.Errorf("calibration: channel %d range %g has implausible gain %g", adj.Channel, adj.Range, gain)
+		}
+	}
+	return nil
+}
+
+type adjustmentKey struct {
+	Channel int
+	Range   float64
+	Type    string
+}
+
+func (k adjustmentKey) String() string {
+	if k.Type == "" {
+		return fmt.Sprintf("Channel %2d Range %g", k.Channel, k.Range)
+	}
+	return fmt.Sprintf("%s %2d Range %g", k.Type, k.Channel, k.Range)
+}
+
+func (c *Calibration) coefficients() map[adjustmentKey][]float64 {
+	m := make(map[adjustmentKey][]float64, len(c.Adjustment.Data))
+	for _, adj := range c.Adjustment.Data {
+		m[adjustmentKey{adj.Channel, adj.Range, adj.Type}] = adj.Orders()
+	}
+	return m
+}
+
+func equalCoefficients(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//Returns one line for every difference between c and n. Empty if equal.
+func (c *Calibration) Diff(n *Calibration) []string {
+	var diff []string
+	attr := func(name, a, b string) {
+		if a != b {
+			diff = append(diff, fmt.Sprintf("%s: %q -> %q", name, a, b))
+		}
+	}
+	attr("Version", c.Adjustment.Version, n.Adjustment.Version)
+	attr("Date", c.Adjustment.Date, n.Adjustment.Date)
+	attr("Hardware", c.Adjustment.Hardware, n.Adjustment.Hardware)
+	attr("Software", c.Adjustment.Software, n.Adjustment.Software)
+
+	var lines []string
+	old, cur := c.coefficients(), n.coefficients()
+	for k, v := range cur {
+		if o, ok := old[k]; !ok {
+			lines = append(lines, fmt.Sprintf("%s: added %v", k, v))
+		} else if !equalCoefficients(o, v) {
+			lines = append(lines, fmt.Sprintf("%s: %v -> %v", k, o, v))
+		}
+	}
+	for k, v := range old {
+		if _, ok := cur[k]; !ok {
+			lines = append(lines, fmt.Sprintf("%s: removed %v", k, v))
+		}
+	}
+	sort.Strings(lines)
+	return append(diff, lines...)
+}
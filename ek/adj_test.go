@@ -0,0 +1,131 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ek
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+//Adjustment data from an EK200C
+func loadAdjDump(t *testing.T) *Calibration {
+	b, err := ioutil.ReadFile("../dumps/adj.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Calibration{}
+	if err = xml.Unmarshal(b, &c.Adjustment); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Validate(EK200C.Channels); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//AdjustValue before Horner evaluation
+func legacyAdjustValue(v float64, adj AdjustmentTable) float64 {
+	switch adj.Orders {
+	case 4:
+		return adj.Order[0] + adj.Order[1]*v + adj.Order[2]*math.Pow10(-9)*math.Pow(v, 2) + adj.Order[3]*math.Pow10(-13)*math.Pow(v, 3)
+	case 3:
+		return adj.Order[0] + adj.Order[1]*v + adj.Order[2]*math.Pow10(-9)*math.Pow(v, 2)
+	case 2:
+		return adj.Order[0] + adj.Order[1]*v
+	}
+	return v
+}
+
+func nearlyEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+func TestAdjustValueLegacy(t *testing.T) {
+	c := loadAdjDump(t)
+	adjt := make([]AdjustmentTable, EK200C.Channels)
+	if err := c.AdjustmentTable(10, EK200C.CoefficientScale[10], adjt); err != nil {
+		t.Fatal(err)
+	}
+	four := 0
+	for ch, adj := range adjt {
+		if adj.Orders == 4 {
+			four++
+		}
+		for v := float64(ENG_MIN); v <= ENG_MAX; v += 250 {
+			if got, want := AdjustValue(v, adj), legacyAdjustValue(v, adj); !nearlyEqual(got, want, 1e-12) {
+				t.Errorf("channel %d: AdjustValue(%g) = %.12g, legacy %.12g", ch, v, got, want)
+			}
+		}
+	}
+	if four == 0 {
+		t.Error("no channel with 4 term adjustment")
+	}
+}
+
+func TestUnadjustValue(t *testing.T) {
+	c := loadAdjDump(t)
+	adjt := make([]AdjustmentTable, EK200C.Channels)
+	if err := c.AdjustmentTable(10, EK200C.CoefficientScale[10], adjt); err != nil {
+		t.Fatal(err)
+	}
+	for ch, adj := range adjt {
+		for x := float64(ENG_MIN); x <= ENG_MAX; x += 125 {
+			if got := UnadjustValue(AdjustValue(x, adj), adj); !nearlyEqual(got, x, 1e-9) {
+				t.Errorf("channel %d: UnadjustValue(AdjustValue(%g)) = %.12g", ch, x, got)
+			}
+		}
+	}
+}
+
+func TestAdjustOrders(t *testing.T) {
+	coefficients := []float64{0.5, 1.001, 2e-6, -3e-10, 4e-14, -5e-18}
+	for _, orders := range []int{0, 1, 2, 3, 5} {
+		adj := AdjustmentTable{}
+		if orders > 0 {
+			adj = AdjustmentTable{Orders: orders + 1, Order: coefficients[:orders+1], Scale: []float64{1, 1, 1, 1, 1, 1}}
+		}
+		for x := float64(ENG_MIN); x <= ENG_MAX; x += 500 {
+			want := x
+			if orders > 0 {
+				want = 0
+				for i, k := range adj.Order {
+					want += k * math.Pow(x, float64(i))
+				}
+			}
+			got := AdjustValue(x, adj)
+			if !nearlyEqual(got, want, 1e-12) {
+				t.Errorf("order %d: AdjustValue(%g) = %.12g, want %.12g", orders, x, got, want)
+			}
+			if back := UnadjustValue(got, adj); !nearlyEqual(back, x, 1e-9) {
+				t.Errorf("order %d: UnadjustValue(%g) = %.12g, want %g", orders, got, back, x)
+			}
+		}
+	}
+}
+
+func TestAdjustmentTableInputsOnly(t *testing.T) {
+	c := loadAdjDump(t)
+	adjt := make([]AdjustmentTable, EK200C.Channels)
+	if err := c.AdjustmentTable(10, EK200C.CoefficientScale[10], adjt); err != nil {
+		t.Fatal(err)
+	}
+	//dumps/adj.xml has an AnalogOutput adjustment for channel 1 range 10 after the input one
+	if adjt[1].Order[0] != 6.2056789 {
+		t.Errorf("channel 1 order 0 = %g, want the input adjustment 6.2056789", adjt[1].Order[0])
+	}
+}
+
+func TestAdjustmentTableUnknownRange(t *testing.T) {
+	c := loadAdjDump(t)
+	adjt := make([]AdjustmentTable, EK200C.Channels)
+	if err := c.AdjustmentTable(5, EK200C.CoefficientScale[5], adjt); err == nil {
+		t.Error("range without coefficient scaling accepted")
+	}
+	if err := c.AdjustmentTable(10, []float64{1, 1, 1e-9}, adjt); err == nil {
+		t.Error("scaling to order 2 accepted for order 3 coefficients")
+	}
+}
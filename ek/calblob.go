@@ -0,0 +1,287 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Decoding of the Calibration element in the calibration reply (0x48).
+// The element is Base64 of a 4 byte little endian length followed by
+// LZO1X compressed XML. The XML is the factory calibration certificate,
+// one Data element for every check done on the unit.
+
+package ek
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const MAX_CALIBRATION_BLOB = 16 << 20 //Refuse to decompress more than this
+
+var errLZOCorrupt = errors.New("lzo: corrupt input")
+
+//One check from the calibration certificate
+type CalibrationCheck struct {
+	Description                string  `xml:"Description,attr"`
+	Channel                    int     `xml:"Channel,attr"`
+	SetpointValue              float64 `xml:"SetpointValue,attr"`
+	SetpointValueUnit          string  `xml:"SetpointValueUnit,attr"`
+	ActualValue                float64 `xml:"ActualValue,attr"`
+	ActualValueUnit            string  `xml:"ActualValueUnit,attr"`
+	Tolerance                  float64 `xml:"Tolerance,attr"`
+	ToleranceUnit              string  `xml:"ToleranceUnit,attr"`
+	Passed                     bool    `xml:"Passed,attr"`
+	MeasuringRange             float64 `xml:"MeasuringRange,attr"`
+	Unipolar                   bool    `xml:"Unipolar,attr"`
+	MeasurementUncertainty     float64 `xml:"MeasurementUncertainty,attr"`
+	MeasurementUncertaintyUnit string  `xml:"MeasurementUncertaintyUnit,attr"`
+}
+
+//Deviation from setpoint
+func (c *CalibrationCheck) Error() float64 {
+	return c.ActualValue - c.SetpointValue
+}
+
+type CalibrationCertificate struct {
+	XMLName  xml.Name `xml:"Calibration"`
+	Version  string   `xml:"Version,attr"`
+	Date     string   `xml:"Date,attr"`
+	Hardware string   `xml:"Hardware,attr"`
+	Software string   `xml:"Software,attr"`
+	Person   string   `xml:"Person,attr"`
+	Location string   `xml:"Location,attr"`
+	Data     []CalibrationCheck
+}
+
+//Summary of the checks done in one measuring range
+type CertificateRange struct {
+	Range    float64
+	Unit     string
+	Checks   int
+	Failed   int
+	MaxError float64 //Largest absolute deviation from setpoint
+	Channels []int
+}
+
+//Checks grouped by measuring range and unit
+func (c *CalibrationCertificate) Ranges() []CertificateRange {
+	type key struct {
+		Range float64
+		Unit  string
+	}
+	m := make(map[key]*CertificateRange)
+	seen := make(map[key]map[int]bool)
+	for _, check := range c.Data {
+		k := key{check.MeasuringRange, check.SetpointValueUnit}
+		r, ok := m[k]
+		if !ok {
+			r = &CertificateRange{Range: k.Range, Unit: k.Unit}
+			m[k] = r
+			seen[k] = make(map[int]bool)
+		}
+		r.Checks++
+		if !check.Passed {
+			r.Failed++
+		}
+		if e := math.Abs(check.Error()); e > r.MaxError {
+			r.MaxError = e
+		}
+		if !seen[k][check.Channel] {
+			seen[k][check.Channel] = true
+			r.Channels = append(r.Channels, check.Channel)
+		}
+	}
+	ranges := make([]CertificateRange, 0, len(m))
+	for _, r := range m {
+		sort.Ints(r.Channels)
+		ranges = append(ranges, *r)
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].Unit != ranges[j].Unit {
+			return ranges[i].Unit < ranges[j].Unit
+		}
+		return ranges[i].Range < ranges[j].Range
+	})
+	return ranges
+}
+
+//Base64 decode the Calibration element. Returns the compressed blob with length header.
+func CalibrationBlob(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+//Decompress blob returned by CalibrationBlob
+func DecompressCalibrationBlob(blob []byte) ([]byte, error) {
+	if len(blob) < 4 {
+		return nil, fmt.Errorf("calibration blob: short blob (%d bytes)", len(blob))
+	}
+	n := binary.LittleEndian.Uint32(blob)
+	if n > MAX_CALIBRATION_BLOB {
+		return nil, fmt.Errorf("calibration blob: length %d too large", n)
+	}
+	return lzo1xDecompress(blob[4:], int(n))
+}
+
+//Decode the Calibration element into a certificate
+func NewCalibrationCertificate(s string) (*CalibrationCertificate, error) {
+	blob, err := CalibrationBlob(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := DecompressCalibrationBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	cert := CalibrationCertificate{}
+	if err = xml.Unmarshal(b, &cert); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+//LZO1X decompression. n is the decompressed length.
+func lzo1xDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	ip := 0
+	//Length with zero byte extension
+	ext := func(base int) (int, error) {
+		t := 0
+		for ip < len(in) && in[ip] == 0 {
+			t += 255
+			ip++
+		}
+		if ip >= len(in) {
+			return 0, errLZOCorrupt
+		}
+		t += base + int(in[ip])
+		ip++
+		return t, nil
+	}
+	literal := func(l int) error {
+		if ip+l > len(in) || len(out)+l > n {
+			return errLZOCorrupt
+		}
+		out = append(out, in[ip:ip+l]...)
+		ip += l
+		return nil
+	}
+	match := func(dist, l int) error {
+		if dist < 1 || dist > len(out) || len(out)+l > n {
+			return errLZOCorrupt
+		}
+		for i := 0; i < l; i++ {
+			out = append(out, out[len(out)-dist])
+		}
+		return nil
+	}
+
+	//0: Expecting literal run, 1: after match with 1-3 literals, 2: after literal run of 4 or more
+	state := 0
+	if len(in) > 0 && in[0] > 17 {
+		l := int(in[0]) - 17
+		ip++
+		if err := literal(l); err != nil {
+			return nil, err
+		}
+		state = 1
+		if l >= 4 {
+			state = 2
+		}
+	}
+	for {
+		if ip >= len(in) {
+			return nil, errLZOCorrupt
+		}
+		t := int(in[ip])
+		ip++
+		if state == 0 && t < 16 {
+			l := t
+			if l == 0 {
+				var err error
+				if l, err = ext(15); err != nil {
+					return nil, err
+				}
+			}
+			if err := literal(l + 3); err != nil {
+				return nil, err
+			}
+			state = 2
+			continue
+		}
+
+		var dist, l int
+		switch {
+		case t >= 64:
+			if ip >= len(in) {
+				return nil, errLZOCorrupt
+			}
+			dist = 1 + (t>>2)&7 + int(in[ip])<<3
+			ip++
+			l = t>>5 + 1
+		case t >= 32:
+			l = t & 31
+			if l == 0 {
+				var err error
+				if l, err = ext(31); err != nil {
+					return nil, err
+				}
+			}
+			l += 2
+			if ip+2 > len(in) {
+				return nil, errLZOCorrupt
+			}
+			dist = 1 + int(in[ip])>>2 + int(in[ip+1])<<6
+			ip += 2
+		case t >= 16:
+			dist = (t & 8) << 11
+			l = t & 7
+			if l == 0 {
+				var err error
+				if l, err = ext(7); err != nil {
+					return nil, err
+				}
+			}
+			l += 2
+			if ip+2 > len(in) {
+				return nil, errLZOCorrupt
+			}
+			dist += int(in[ip])>>2 + int(in[ip+1])<<6
+			ip += 2
+			if dist == 0 { //End of stream
+				if len(out) != n {
+					return nil, fmt.Errorf("lzo: got %d bytes, expected %d", len(out), n)
+				}
+				return out, nil
+			}
+			dist += 0x4000
+		default:
+			if ip >= len(in) {
+				return nil, errLZOCorrupt
+			}
+			if state == 2 {
+				dist = 1 + 0x800 + t>>2 + int(in[ip])<<2
+				l = 3
+			} else {
+				dist = 1 + t>>2 + int(in[ip])<<2
+				l = 2
+			}
+			ip++
+		}
+		if err := match(dist, l); err != nil {
+			return nil, err
+		}
+		s := int(in[ip-2]) & 3
+		if s == 0 {
+			state = 0
+			continue
+		}
+		if err := literal(s); err != nil {
+			return nil, err
+		}
+		state = 1
+	}
+}
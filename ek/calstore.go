@@ -0,0 +1,71 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Last known good calibration storage
+
+package ek
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//Keeps the last valid calibration reply from each device on disk.
+//One file per device serial containing the XML as received.
+type CalibrationStore struct {
+	Dir string
+}
+
+func NewCalibrationStore(dir string) *CalibrationStore {
+	return &CalibrationStore{Dir: dir}
+}
+
+func (s *CalibrationStore) path(serial string) string {
+	serial = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' || r == 0 {
+			return '_'
+		}
+		return r
+	}, serial)
+	return filepath.Join(s.Dir, serial+".xml")
+}
+
+//Load and validate stored calibration for serial
+func (s *CalibrationStore) Load(serial string, channels int) (*Calibration, error) {
+	b, err := ioutil.ReadFile(s.path(serial))
+	if err != nil {
+		return nil, err
+	}
+	calib, err := NewCalibration(b)
+	if err != nil {
+		return nil, err
+	}
+	if err = calib.Validate(channels); err != nil {
+		return nil, err
+	}
+	return calib, nil
+}
+
+//Save raw calibration XML for serial. Replaces the old file atomically.
+func (s *CalibrationStore) Save(serial string, b []byte) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(s.Dir, "calib")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(b); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	return os.Rename(fh.Name(), s.path(serial))
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Device clock from sync replies (0x8020).
+// The first four bytes of the reply is a counter that counts microseconds
+// from power on, the same clock as the sample timestamps. The rest of the
+// request is echoed, so the reply carries the time it was sent.
+
+package ek
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DEVICE_CLOCK_HZ = 1e6 //Nominal counter rate
+	SYNC_WINDOW     = 32  //Sync replies used for the clock estimate
+	MAX_CLOCK_STEP  = 1e6 //Counter this far (1s) from where it should be means the unit restarted
+)
+
+const MAX_SYNC_RTT = 5 * time.Second //Replies older than this are not ours or useless
+
+//One sync request and its reply
+type SyncSample struct {
+	Sent     time.Time
+	Received time.Time
+	Counter  uint64 //Unwrapped device counter
+}
+
+func (s SyncSample) RTT() time.Duration {
+	return s.Received.Sub(s.Sent)
+}
+
+//Local time the counter was read, assuming the same delay both ways
+func (s SyncSample) Local() time.Time {
+	return s.Sent.Add(s.RTT() / 2)
+}
+
+//Maps device counter to local time
+type DeviceClock struct {
+	mu      sync.Mutex
+	samples []SyncSample //Last SYNC_WINDOW samples, oldest first
+	rate    float64      //Counts per second
+}
+
+//Add sync reply. Returns false if the counter did not follow the previous
+//replies and the estimate was started over.
+func (c *DeviceClock) Add(sent, received time.Time, counter uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := SyncSample{Sent: sent, Received: received, Counter: uint64(counter)}
+	ok := true
+	if n := len(c.samples); n > 0 {
+		last := c.samples[n-1]
+		s.Counter = last.Counter + uint64(counter-uint32(last.Counter))
+		expected := float64(last.Counter) + s.Local().Sub(last.Local()).Seconds()*c.rateLocked()
+		if math.Abs(float64(s.Counter)-expected) > MAX_CLOCK_STEP {
+			c.samples = nil
+			c.rate = 0
+			s.Counter = uint64(counter)
+			ok = false
+		}
+	}
+	c.samples = append(c.samples, s)
+	if len(c.samples) > SYNC_WINDOW {
+		c.samples = c.samples[1:]
+	}
+	first, last := c.samples[0], c.samples[len(c.samples)-1]
+	if dt := last.Local().Sub(first.Local()).Seconds(); dt > 0 {
+		c.rate = float64(last.Counter-first.Counter) / dt
+	}
+	return ok
+}
+
+func (c *DeviceClock) rateLocked() float64 {
+	if c.rate == 0 {
+		return DEVICE_CLOCK_HZ
+	}
+	return c.rate
+}
+
+//Counter rate in Hz. Nominal rate until there are two sync replies.
+func (c *DeviceClock) Rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rateLocked()
+}
+
+//Round trip time of the last sync
+func (c *DeviceClock) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return 0
+	}
+	return c.samples[len(c.samples)-1].RTT()
+}
+
+func (c *DeviceClock) Synced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.samples) > 0
+}
+
+//Sample with the lowest round trip time. Its local time is the most accurate.
+func (c *DeviceClock) reference() SyncSample {
+	ref := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.RTT() <= ref.RTT() {
+			ref = s
+		}
+	}
+	return ref
+}
+
+//Local time when the counter was zero
+func (c *DeviceClock) Boot() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return time.Time{}
+	}
+	ref := c.reference()
+	return ref.Local().Add(-time.Duration(float64(ref.Counter) / c.rateLocked() * float64(time.Second)))
+}
+
+//Time since the unit was powered on
+func (c *DeviceClock) Uptime() time.Duration {
+	boot := c.Boot()
+	if boot.IsZero() {
+		return 0
+	}
+	return time.Since(boot)
+}
+
+//Local time of a sample timestamp. False until there is a sync reply.
+//The timestamp is taken to be within half a wrap (35 minutes) of the last sync.
+func (c *DeviceClock) Time(ts uint32) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return time.Time{}, false
+	}
+	last := c.samples[len(c.samples)-1].Counter
+	u := int64(last) + int64(int32(ts-uint32(last)))
+	ref := c.reference()
+	d := float64(u-int64(ref.Counter)) / c.rateLocked()
+	return ref.Local().Add(time.Duration(d * float64(time.Second))), true
+}
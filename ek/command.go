@@ -0,0 +1,193 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Protocol commands. A reply carries the command of its request with
+// bit 15 set, so 0x48 is answered by 0x8048 (-32696 as int16).
+
+package ek
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+type Command int16
+
+const RESPONSE Command = -0x8000 //Bit 15, set in replies
+
+const (
+	CMD_START          Command = 0x01
+	CMD_STOP           Command = 0x02
+	CMD_UNIT_INFO      Command = 0x07
+	CMD_SYNC           Command = 0x20
+	CMD_INIT           Command = 0x2a
+	CMD_CALIB_INFO     Command = 0x40
+	CMD_NET_INFO       Command = 0x44
+	CMD_CALIBRATION    Command = 0x48
+	CMD_CHANNEL_INFO   Command = 0x50
+	CMD_CHANNEL_SETUP  Command = 0x51
+	CMD_CHANNEL_DATA   Command = 0x80
+	CMD_TEMPERATURE    Command = 0x82
+	CMD_STATUS         Command = 0x86
+	CMD_CHANNEL_STATUS Command = 0x87
+)
+
+const UNKNOWN_PAYLOADS = 5 //Payloads kept per unknown command
+
+//Init request payload. Meaning unknown, vendor software always sends the same.
+type InitRequest struct {
+	Unknown [8]byte
+}
+
+var DefaultInitRequest = InitRequest{[8]byte{0x03, 0x01, 0x00, 0x13, 0x00, 0x02, 0x00, 0x00}}
+
+//Sync request payload. Local time.
+type SyncRequest struct {
+	Counter uint32 //Zero in requests
+	Time    int64  //UnixNano
+}
+
+//Sync reply payload. The unit fills in its counter and echoes the rest.
+type SyncResponse struct {
+	Counter uint32 //Microseconds since power on
+	Time    int64  //From request
+}
+
+//Unit info reply payload. Strings are zero terminated.
+type UnitInfoResponse struct {
+	Unknown1 [0x20]byte
+	Serial   [0x10]byte
+	Unknown2 [0x0a]byte
+	MAC      [6]byte
+	Firmware [0x10]byte
+	Article  [0x10]byte
+}
+
+type CommandInfo struct {
+	Name     string
+	Request  interface{} //Request payload, nil when empty or not understood
+	Response interface{} //Reply payload, nil when empty or not understood
+}
+
+//Known commands by request code
+var commands = map[Command]CommandInfo{
+	CMD_START:          {Name: "Start streaming"},
+	CMD_STOP:           {Name: "Stop streaming"},
+	CMD_UNIT_INFO:      {Name: "Unit info", Response: UnitInfoResponse{}},
+	CMD_SYNC:           {Name: "Sync", Request: SyncRequest{}, Response: SyncResponse{}},
+	CMD_INIT:           {Name: "Init", Request: InitRequest{}},
+	CMD_CALIB_INFO:     {Name: "Calib info"},
+	CMD_NET_INFO:       {Name: "Network info"},
+	CMD_CALIBRATION:    {Name: "Calibration"},
+	CMD_CHANNEL_INFO:   {Name: "Channel info?"},
+	CMD_CHANNEL_SETUP:  {Name: "Channel setup?"},
+	CMD_CHANNEL_DATA:   {Name: "Channel data"},
+	CMD_TEMPERATURE:    {Name: "Junction temperature?"},
+	CMD_STATUS:         {Name: "Status?"},
+	CMD_CHANNEL_STATUS: {Name: "Channel status?"},
+}
+
+//Add or replace a command
+func RegisterCommand(c Command, info CommandInfo) {
+	commands[c.Request()] = info
+}
+
+//Information for command or reply
+func LookupCommand(c Command) (CommandInfo, bool) {
+	info, ok := commands[c.Request()]
+	return info, ok
+}
+
+func (c Command) IsResponse() bool {
+	return c&RESPONSE != 0
+}
+
+//Command of request, response bit cleared
+func (c Command) Request() Command {
+	return c &^ RESPONSE
+}
+
+//Command of reply
+func (c Command) Response() Command {
+	return c | RESPONSE
+}
+
+func (c Command) Known() bool {
+	_, ok := commands[c.Request()]
+	return ok
+}
+
+func (c Command) String() string {
+	name := "Unknown"
+	if info, ok := commands[c.Request()]; ok {
+		name = info.Name
+	}
+	if c.IsResponse() {
+		name += " reply"
+	}
+	return fmt.Sprintf("%s (0x%04x)", name, uint16(c))
+}
+
+//Decode payload into the struct registered for command. nil if there is none.
+func DecodePayload(c Command, data []byte) (interface{}, error) {
+	info, ok := commands[c.Request()]
+	proto := info.Request
+	if c.IsResponse() {
+		proto = info.Response
+	}
+	if !ok || proto == nil {
+		return nil, nil
+	}
+	v := reflect.New(reflect.TypeOf(proto))
+	if len(data) < binary.Size(proto) {
+		return nil, fmt.Errorf("%s: short payload (%d bytes)", c, len(data))
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+//Counts commands not in the registry and keeps their first payloads
+type UnknownCommands struct {
+	mu       sync.Mutex
+	count    map[Command]int
+	payloads map[Command][][]byte
+}
+
+//Count command. Returns number of times it has been seen.
+func (u *UnknownCommands) Add(c Command, data []byte) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.count == nil {
+		u.count = make(map[Command]int)
+		u.payloads = make(map[Command][][]byte)
+	}
+	u.count[c]++
+	if len(u.payloads[c]) < UNKNOWN_PAYLOADS {
+		u.payloads[c] = append(u.payloads[c], append([]byte(nil), data...))
+	}
+	return u.count[c]
+}
+
+//Times seen by command
+func (u *UnknownCommands) Counts() map[Command]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := make(map[Command]int, len(u.count))
+	for c, n := range u.count {
+		counts[c] = n
+	}
+	return counts
+}
+
+//First payloads seen for command
+func (u *UnknownCommands) Payloads(c Command) [][]byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([][]byte(nil), u.payloads[c]...)
+}
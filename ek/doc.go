@@ -0,0 +1,11 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ek is the ExpertKey protocol code shared by the commands: frames
+// and the command registry, the receiver, device profiles, factory and site
+// calibration, clock, gap, quality and watchdog tracking.
+//
+// The commands import it as delphin/ek, so the repository is checked out as
+// $GOPATH/src/delphin.
+package ek
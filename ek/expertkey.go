@@ -0,0 +1,721 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Protocol Library for Delphin ExpertKey DAQs
+
+//Identified request types.
+//NOTE: The unit ignores header and data CRCs.
+//&EKHeader{2,0x01,0,0,0,0,0} //Request streaming data
+//&EKHeader{2,0x44,0,0,0,0,0} //Request unit information
+//&EKHeader{2,0x40,0,0,0,0,0} //Request calib info
+//&EKHeader{2,0x48,0,0,0,0,0} //Request calib info (Base64 Encoded?)
+
+//&EKHeader{2,0x50,0,0,0,0,0} //No idea what this returns. Maybe chan info.
+
+//&EKHeader{2,0x20,0x0c,0,0,0,0} //Sync. Reply has the unit clock (us since power on, BE) in the first 4 bytes. Rest is echoed
+// Data Examples:                         Time
+// -> 00 00 00 00 80 ad 81 1e 53 46 80 0e (22ms)
+// <- 5e 61 45 64 80 ad 81 1e 53 46 80 0e (25ms)
+// -> 00 00 00 00 00 f4 8b 2a 53 46 80 0e (228ms)
+// <- 5e 64 6a 41 00 f4 8b 2a 53 46 80 0e (231ms)
+// -> 00 00 00 00 40 d1 d6 49 53 46 80 0e (753ms)
+// <- 5e 6c 6d 2b 40 d1 d6 49 53 46 80 0e (794ms)
+// -> 00 00 00 00 c0 a1 39 82 53 46 80 0e (1699ms)
+// <- 5e 7a da 73 c0 a1 39 82 53 46 80 0e (1701ms)
+// -> 00 00 00 00 40 80 c3 c1 53 46 80 0e (2765ms)
+// <- 5e 8b 1f 15 40 80 c3 c1 53 46 80 0e (2794ms)
+// -> 00 00 00 00 80 0e 17 fa 53 46 80 0e (3710ms)
+// <- 5e 99 8a b0 80 0e 17 fa 53 46 80 0e (3712ms)
+// -> 00 00 00 00 40 0b bc 38 54 46 80 0e (4761ms)
+// <- 5e a9 93 bf 40 0b bc 38 54 46 80 0e (4794ms)
+
+//&EKHeader{2,0x2a,0x08,0,0,0,0} //First Packet. Data = 03 01 00 13 00 02 00 00
+//Empty Packet returend
+
+//&EKHeader{2,0x07,0x08,0,0,0,0} //Unit info. Firmware version ++
+
+package ek
+
+import (
+	"bytes"
+	"container/ring"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ENG_MAX = 10000
+	ENG_MIN = -10000
+
+	BUFFER_SIZE     = 3000 // Buffer for filtered values 300 sec @ Reduction factor = 10
+	RAW_BUFFER_SIZE = 2500 //Keep raw values around for 25 seconds @ 100Hz
+)
+
+type EKReceiver struct {
+	ValueBufferRaw  []*ring.Ring          //Holds raw buffer
+	ValueBuffer     []*ring.Ring          //Holds filtered buffer
+	AdjustmentTable []AdjustmentTable     //Holds channel adjustment data
+	Calibration     *Calibration          //Last known good calibration
+	CalibStore      *CalibrationStore     //Persist calibration per unit. nil disables
+	SiteAdjustment  []*SiteCalibration    //Field calibration per channel. nil where there is none
+	SiteCalStore    *SiteCalibrationStore //Field calibration records. nil disables
+	OpenCircuit     []float64             //Open circuit threshold in mV per channel, see ParseOpenCircuit. 0 or nil disables
+	Profile         *DeviceProfile        //Model specific layout
+	UnitInfo        EKUnitInfo            //Reply to unit info request
+
+	FIRTaps    int           //For filter
+	SampleTime time.Duration //Sample the filtered buffer this often
+
+	FrameHook func(EKHeader, []byte) //Called with every frame received. Optional
+	Unknown   UnknownCommands        //Commands not in the registry
+	Clock     DeviceClock            //Unit clock from sync replies
+	Gaps      *SampleTracker         //Gap and duplicate detection per channel
+	Watchdog  *Watchdog              //Stale and flatline detection per channel
+	Stats     ReceiverStats          //Connection and traffic counters
+
+	addr        string                  //IP+Port
+	calc_chan   chan EKChannelData //Value calculations
+	buffer_chan chan EKChannelData //Value buffer
+
+	at0 time.Time
+	ts0 uint32
+
+	wmu        sync.Mutex //Held while writing to conn
+	smu        sync.Mutex //Held while using sequencenr
+	connected  bool
+	siteLoaded time.Time //Last loadSiteCalibration
+	sequencenr int32
+	conn       net.Conn
+}
+
+type EKHeader struct {
+	Ver int16
+	Com Command
+
+	Len   int32
+	Param int32
+	Seq   int32
+
+	DataCheck   int32
+	HeaderCheck int32
+}
+
+type EKRawData struct {
+	Timestamp uint32
+	ChanValue int32 //Channel (6bit) + Value (26bit @ 1hz, 22 bit @ 50Hz)
+}
+
+//Raw data value and raw metadata
+type EKChannelData struct {
+	PacketTime   time.Time
+	Timestamp    uint32
+	Channel      uint8
+	RawValue     int32 //Raw, left justified to 32 bit
+	Value        float64
+	Abstimestamp time.Time
+	Status       SampleStatus //Gap or restart before this sample
+	Quality      Quality
+	Last         bool //Last value in packet
+	PacketData1  uint32
+	PacketData2  uint32
+}
+
+//Unit info reply (0x07)
+type EKUnitInfo struct {
+	Serial   string
+	MAC      net.HardwareAddr
+	Model    string //First word of firmware string
+	Firmware string
+	Article  string //Looks like an article or order number (M-21003609)
+}
+
+//Useful information
+type ChannelData struct {
+	Timestamp time.Time
+	Value     float64
+	Gap       bool //Samples missing before this one
+	Quality   Quality
+}
+
+// Process values coming from ADC
+func valueBuffer(d *EKReceiver) {
+	last_sample := make([]time.Time, d.Profile.Channels)
+	gap := make([]bool, d.Profile.Channels)         //Gap since last filtered value
+	quality := make([]Quality, d.Profile.Channels) //Flags since last filtered value
+
+	for i := 0; i < d.Profile.Channels; i++ {
+		d.ValueBufferRaw[i] = ring.New(RAW_BUFFER_SIZE)
+		d.ValueBuffer[i] = ring.New(BUFFER_SIZE)
+	}
+	for {
+		v := <-d.buffer_chan
+		gap[v.Channel] = gap[v.Channel] || v.Status != SAMPLE_OK
+		quality[v.Channel] |= v.Quality
+
+		//Move head forwards
+		d.ValueBufferRaw[v.Channel] = d.ValueBufferRaw[v.Channel].Next()
+		d.ValueBufferRaw[v.Channel].Value = ChannelData{v.Abstimestamp, v.Value, v.Status != SAMPLE_OK, v.Quality} //Set value
+
+		// FIR Calculation
+		p0 := d.ValueBufferRaw[v.Channel]
+		i := 0
+		out := float64(0)
+		for ; i < d.FIRTaps && p0.Value != nil; i++ {
+			out += p0.Value.(ChannelData).Value
+			p0 = p0.Prev()
+		}
+		out = out / float64(i)
+		if v.Abstimestamp.Sub(last_sample[v.Channel]) >= d.SampleTime {
+			d.ValueBuffer[v.Channel] = d.ValueBuffer[v.Channel].Next()
+			if gap[v.Channel] {
+				quality[v.Channel] |= QUALITY_INTERPOLATED
+			}
+			d.ValueBuffer[v.Channel].Value = ChannelData{v.Abstimestamp, out, gap[v.Channel], quality[v.Channel]}
+			gap[v.Channel] = false
+			quality[v.Channel] = QUALITY_GOOD
+			last_sample[v.Channel] = v.Abstimestamp
+		}
+	}
+}
+
+//Correct Timestamp and Engineering Value
+func valueCalc(d *EKReceiver) {
+	td := uint64(0)
+	sync := true
+	m := 0
+	for {
+		i := <-d.calc_chan
+
+		//Calculate and Adjust Engineering value
+		i.Value = d.engValue(i.Channel, float64(i.RawValue))
+		i.Quality = d.valueQuality(i.Channel, float64(i.RawValue))
+
+		//Convert timestamp to Absolute timestamp
+		//Note: This timestamp can be sligltly in the future. (100ms)
+		//The timstamp relative to other mesurements is more important
+		//There is about 70ms drift over an hour on my unit.
+		//Sync every 100k mesurments, this causes some jitter due to network latency (+-1ms)
+		//Somekind of incremental adjustment would be better
+
+		if sync || i.Status == SAMPLE_RESTART {
+			sync = false
+			d.at0 = i.PacketTime
+			td = 0
+			d.ts0 = i.Timestamp
+		}
+
+		//Modulo 2**32. Out of order samples are dropped before this
+		td += uint64(i.Timestamp - d.ts0)
+		d.ts0 = i.Timestamp
+		i.Abstimestamp = d.at0.Add(time.Duration(td * 1000))
+		if t, ok := d.Clock.Time(i.Timestamp); ok {
+			i.Abstimestamp = t //Unit clock from sync replies. No network jitter or drift
+		}
+		d.buffer_chan <- i
+
+		if m > 100000 {
+			if i.Last {
+				sync = true
+				m = 0
+			}
+		}
+		m++
+	}
+}
+
+
+// Calculate Absolute Timestamp
+
+//Zero terminated string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+//Decode unit info reply payload
+func ParseUnitInfo(b []byte) (EKUnitInfo, error) {
+	var info EKUnitInfo
+	p, err := DecodePayload(CMD_UNIT_INFO.Response(), b)
+	if err != nil {
+		return info, err
+	}
+	r := p.(UnitInfoResponse)
+	info.Serial = cString(r.Serial[:])
+	info.MAC = net.HardwareAddr(append([]byte(nil), r.MAC[:]...))
+	info.Firmware = cString(r.Firmware[:])
+	if f := strings.Fields(info.Firmware); len(f) > 0 {
+		info.Model = f[0]
+	}
+	info.Article = cString(r.Article[:])
+	return info, nil
+}
+
+//Factory adjustment followed by site calibration
+func (d *EKReceiver) engValue(ch uint8, raw float64) float64 {
+	v := AdjustValue(float64(raw/d.Profile.RawMax)*ENG_MAX, d.AdjustmentTable[ch])
+	if s := d.SiteAdjustment[ch]; s != nil {
+		v = s.Apply(v)
+	}
+	return v
+}
+
+//Range, open input and calibration flags for raw value on channel ch
+func (d *EKReceiver) valueQuality(ch uint8, raw float64) Quality {
+	v := float64(raw/d.Profile.RawMax) * ENG_MAX
+	q := RangeQuality(v)
+	if int(ch) < len(d.OpenCircuit) {
+		q |= OpenCircuitQuality(v, d.OpenCircuit[ch])
+	}
+	if d.AdjustmentTable[ch].Orders == 0 {
+		q |= QUALITY_UNCALIBRATED
+	}
+	return q
+}
+
+//Inverse of engValue. Raw value for engineering value v on channel ch.
+func (d *EKReceiver) EngToRaw(ch uint8, v float64) float64 {
+	if s := d.SiteAdjustment[ch]; s != nil {
+		v = s.Unapply(v)
+	}
+	return UnadjustValue(v, d.AdjustmentTable[ch]) / ENG_MAX * d.Profile.RawMax
+}
+
+//Ask unit at addr for unit info on a short lived connection.
+//Used to find the model before setting up a receiver.
+func ProbeEK(addr string, timeout time.Duration) (EKUnitInfo, error) {
+	var info EKUnitInfo
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return info, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	binary.Write(conn, binary.BigEndian, &EKHeader{2, CMD_INIT, 0x08, 0, 0, 0, 0})
+	binary.Write(conn, binary.BigEndian, &DefaultInitRequest)
+	binary.Write(conn, binary.BigEndian, &EKHeader{2, CMD_UNIT_INFO, 0x00, 0, 1, 0, 0})
+	for {
+		head, data, err := ReadPacket(conn)
+		if err != nil {
+			return info, err
+		}
+		if head.Com == CMD_UNIT_INFO.Response() {
+			return ParseUnitInfo(data)
+		}
+	}
+}
+
+//Probe unit and pick matching profile. Falls back to DefaultProfile.
+func ProbeProfile(addr string) *DeviceProfile {
+	info, err := ProbeEK(addr, 5*time.Second)
+	if err != nil {
+		log.Printf("Could not probe %s: %s. Using %s profile\n", addr, err, DefaultProfile.Name)
+		return DefaultProfile
+	}
+	p := LookupProfile(info.Model)
+	if p == nil {
+		log.Printf("Unknown model %s at %s. Using %s profile\n", info.Model, addr, DefaultProfile.Name)
+		return DefaultProfile
+	}
+	log.Printf("%s is %s (serial %s)\n", addr, p.Name, info.Serial)
+	return p
+}
+
+//Read one frame, header and data, from conn
+func ReadPacket(conn net.Conn) (EKHeader, []byte, error) {
+	var header EKHeader
+	err := binary.Read(conn, binary.BigEndian, &header)
+	if err != nil {
+		return header, nil, err
+	}
+	if header.Len > 0 {
+		buf := make([]byte, header.Len)
+		for nn := int32(0); nn < header.Len; {
+			kk, err := conn.Read(buf[nn:])
+			if err != nil {
+				return header, nil, err
+			}
+			nn += int32(kk)
+		}
+		return header, buf, nil
+	}
+	return header, nil, nil
+}
+
+//Send initial request for Init, Calib Data and Streaming
+func (d *EKReceiver) postConnect() {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	request := &EKHeader{2, CMD_INIT, 0x08, 0, 0, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	binary.Write(d.conn, binary.BigEndian, &DefaultInitRequest)
+	request = &EKHeader{2, CMD_UNIT_INFO, 0x00, 0, 1, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	request = &EKHeader{2, CMD_CALIBRATION, 0x00, 0, 2, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	request = &EKHeader{2, CMD_START, 0, 0, 3, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	request = &EKHeader{2, CMD_SYNC, 0x0c, 0, 4, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	binary.Write(d.conn, binary.BigEndian, &SyncRequest{Time: time.Now().UnixNano()})
+	d.connected = true
+	d.smu.Lock()
+	d.sequencenr = int32(5)
+	d.smu.Unlock()
+}
+
+func (d *EKReceiver) connectEK() error {
+	log.Printf("Connecting to %s...\n", d.addr)
+	var err error
+	d.conn, err = net.Dial("tcp", d.addr)
+	if err != nil {
+		log.Printf("Connection Error: %s", err)
+		return err
+	}
+	log.Printf("Connected...\n")
+	d.Stats.Connect(time.Now())
+	d.Gaps.Reconnect()
+	d.postConnect()
+	return nil
+}
+
+//Receiver loop
+func (d *EKReceiver) receiverLoop(fn func(EKChannelData)) {
+	for {
+		if d.conn == nil {
+			return
+		}
+		head, data, err := ReadPacket(d.conn)
+		ptime := time.Now()
+		if err != nil {
+			log.Printf("%s\n", err)
+			return
+		}
+		if d.FrameHook != nil {
+			d.FrameHook(head, data)
+		}
+		samples := 0
+		if head.Com == CMD_CHANNEL_DATA {
+			samples = len(data) / 8
+			if len(data)%8 != 0 {
+				d.Stats.DecodeError() //Partial sample, ignored
+			}
+		}
+		d.Stats.Packet(ptime, samples)
+//		fmt.Printf("Packet: %#v\n", head)
+		switch head.Com {
+		case CMD_CHANNEL_DATA:
+			if ptime.Sub(d.siteLoaded) >= SITECAL_RELOAD {
+				d.loadSiteCalibration()
+			}
+			databuf := bytes.NewBuffer(data)
+			//fmt.Printf("%0x\n", databuf)
+			for databuf.Len() >= 8 {
+				var timestamp uint32
+				var chanvalue uint32
+				var chvalue EKChannelData
+				if databuf.Len() == 8 {
+					chvalue.Last = true
+				}
+				binary.Read(databuf, binary.LittleEndian, &timestamp)
+				binary.Read(databuf, binary.LittleEndian, &chanvalue)
+				chvalue.PacketData1 = timestamp;
+				chvalue.PacketData2 = chanvalue;
+				chvalue.Timestamp = timestamp
+				chvalue.Channel = d.Profile.Channel(chanvalue)
+				if int(chvalue.Channel) >= d.Profile.Channels {
+					d.Stats.Drop()
+					continue
+				}
+				status, missing := d.Gaps.Check(chvalue.Channel, timestamp)
+				switch status {
+				case SAMPLE_DUPLICATE, SAMPLE_OUT_OF_ORDER:
+					d.Stats.Drop()
+					continue
+				case SAMPLE_GAP:
+					log.Printf("Unit %s channel %d: %d samples missing\n", d.addr, chvalue.Channel, missing)
+				case SAMPLE_RESTART:
+					log.Printf("Unit %s channel %d: timestamps started over\n", d.addr, chvalue.Channel)
+				}
+				chvalue.Status = status
+				chvalue.RawValue = d.Profile.RawValue(chanvalue)
+				chvalue.Value = d.engValue(chvalue.Channel, float64(chvalue.RawValue))
+				chvalue.Quality = d.valueQuality(chvalue.Channel, float64(chvalue.RawValue))
+				chvalue.PacketTime = ptime
+				chvalue.Abstimestamp, _ = d.Clock.Time(timestamp)
+				chvalue.Quality |= d.Watchdog.Sample(chvalue.Channel, ptime, chvalue.Value)
+				if t, ok := d.Clock.Time(timestamp); ok && chvalue.Last {
+					d.Stats.ClockOffset(ptime.Sub(t))
+				}
+				fn(chvalue)
+			}
+			databuf.Reset()
+		case CMD_UNIT_INFO.Response():
+			info, err := ParseUnitInfo(data)
+			if err != nil {
+				d.Stats.DecodeError()
+				log.Printf("%s\n", err)
+				break
+			}
+			d.UnitInfo = info
+			log.Printf("Unit %s: Serial %s Firmware %s\n", d.addr, info.Serial, info.Firmware)
+			if p := LookupProfile(info.Model); p == nil {
+				log.Printf("Unknown model %s. Using %s profile\n", info.Model, d.Profile.Name)
+			} else if p != d.Profile {
+				log.Printf("Unit %s is %s but receiver was set up for %s\n", d.addr, p.Name, d.Profile.Name)
+			}
+			if d.Calibration == nil {
+				d.loadCalibration()
+			}
+			d.loadSiteCalibration()
+		case CMD_CALIBRATION.Response():
+			d.handleCalibration(data)
+		case CMD_SYNC.Response():
+			d.handleSync(data, ptime)
+		default:
+			if !head.Com.Known() && d.Unknown.Add(head.Com, data) == 1 {
+				log.Printf("Unknown command %s from %s (%d bytes)\n", head.Com, d.addr, len(data))
+			}
+		}
+	}
+}
+
+//Update device clock from sync reply. Replies to requests from others (ekproxy clients) are ignored.
+func (d *EKReceiver) handleSync(data []byte, received time.Time) {
+	p, err := DecodePayload(CMD_SYNC.Response(), data)
+	if err != nil {
+		d.Stats.DecodeError()
+		log.Printf("%s\n", err)
+		return
+	}
+	r := p.(SyncResponse)
+	sent := time.Unix(0, r.Time)
+	if rtt := received.Sub(sent); rtt < 0 || rtt > MAX_SYNC_RTT {
+		return
+	}
+	first := !d.Clock.Synced()
+	if !d.Clock.Add(sent, received, r.Counter) {
+		log.Printf("Unit %s restarted. Clock estimate started over\n", d.addr)
+		d.Gaps.Restart()
+	}
+	if first {
+		log.Printf("Unit %s: uptime %v, rtt %v\n", d.addr, d.Clock.Uptime(), d.Clock.RTT())
+	}
+}
+
+//Calibration store key. Serial when known, address otherwise.
+func (d *EKReceiver) unitKey() string {
+	if d.UnitInfo.Serial != "" {
+		return d.UnitInfo.Serial
+	}
+	return d.addr
+}
+
+func (d *EKReceiver) parseCalibration(data []byte) (*Calibration, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("calibration: short reply (%d bytes)", len(data))
+	}
+	calib, err := NewCalibration(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	if err = calib.Validate(len(d.AdjustmentTable)); err != nil {
+		return nil, err
+	}
+	if err = calib.ValidateScale(d.Profile.Range, d.Profile.CoefficientScale[d.Profile.Range]); err != nil {
+		return nil, err
+	}
+	return calib, nil
+}
+
+//Validate and use calibration reply. Keeps last known good calibration if the reply is broken.
+func (d *EKReceiver) handleCalibration(data []byte) {
+	calib, err := d.parseCalibration(data)
+	if err != nil {
+		d.Stats.DecodeError()
+		log.Printf("Bad calibration from %s: %s\n", d.addr, err)
+		if d.Calibration == nil {
+			d.loadCalibration()
+		}
+		if d.Calibration == nil {
+			log.Printf("No calibration for %s. Values are not adjusted\n", d.addr)
+		}
+		return
+	}
+	prev := d.Calibration
+	if prev == nil && d.CalibStore != nil {
+		prev, _ = d.CalibStore.Load(d.unitKey(), len(d.AdjustmentTable))
+	}
+	if prev != nil {
+		for _, l := range prev.Diff(calib) {
+			log.Printf("Calibration changed for %s: %s\n", d.unitKey(), l)
+		}
+	}
+	if d.CalibStore != nil {
+		if err := d.CalibStore.Save(d.unitKey(), data[4:]); err != nil {
+			log.Printf("Could not store calibration: %s\n", err)
+		}
+	}
+	d.applyCalibration(calib)
+}
+
+//Use stored calibration for this unit if there is one
+func (d *EKReceiver) loadCalibration() {
+	if d.CalibStore == nil {
+		return
+	}
+	calib, err := d.CalibStore.Load(d.unitKey(), len(d.AdjustmentTable))
+	if err != nil {
+		log.Printf("No stored calibration for %s: %s\n", d.unitKey(), err)
+		return
+	}
+	log.Printf("Using stored calibration for %s from %s\n", d.unitKey(), calib.Adjustment.Date)
+	d.applyCalibration(calib)
+}
+
+//Use field calibration records for this unit. Also called every SITECAL_RELOAD
+//while streaming, so new records and records dated ahead take effect.
+func (d *EKReceiver) loadSiteCalibration() {
+	d.siteLoaded = time.Now()
+	if d.SiteCalStore == nil {
+		return
+	}
+	records, err := d.SiteCalStore.Load()
+	if err != nil {
+		log.Printf("Could not load site calibration: %s\n", err)
+		return
+	}
+	active := ActiveSiteCalibration(records, d.unitKey(), len(d.SiteAdjustment), d.siteLoaded)
+	for ch, s := range active {
+		if s != nil && (d.SiteAdjustment[ch] == nil || d.SiteAdjustment[ch].ID != s.ID) {
+			log.Printf("Site calibration %s\n", s)
+		}
+	}
+	copy(d.SiteAdjustment, active)
+}
+
+//Convert calibration to adjustment table
+func (d *EKReceiver) applyCalibration(calib *Calibration) {
+	adjt := make([]AdjustmentTable, len(d.AdjustmentTable))
+	if err := calib.AdjustmentTable(d.Profile.Range, d.Profile.CoefficientScale[d.Profile.Range], adjt); err != nil {
+		log.Printf("Calibration for %s not used: %s\n", d.unitKey(), err)
+		return
+	}
+	copy(d.AdjustmentTable, adjt)
+	d.Calibration = calib
+	log.Printf("New adjustment table:\n%3s %16s %16s %16s %16s\n", "Chan", "Order0", "Order1", "Order2", "Order3")
+	for v, _ := range d.AdjustmentTable {
+		fmt.Printf("%3d ", v)
+		for _, w := range d.AdjustmentTable[v].Order {
+			fmt.Printf("%16e ", w)
+		}
+		fmt.Printf("\n")
+	}
+}
+
+//Start streaming data from EK device.
+//Never returns. Will handle d.connection errors by red.connecting.
+func (d *EKReceiver) Stream(fn func(EKChannelData)) {
+	for {
+		err := d.connectEK()
+		if err == nil {
+			d.receiverLoop(fn)
+			d.wmu.Lock()
+			d.connected = false
+			d.conn.Close()
+			d.wmu.Unlock()
+		}
+		log.Printf("Socket Read Error... Reconnecting\n")
+		time.Sleep(10000 * time.Millisecond)
+	}
+}
+
+var errNotConnected = errors.New("not connected")
+
+//Send command to unit. Returns the sequence number used.
+func (d *EKReceiver) Send(com Command, param int32, data []byte) (int32, error) {
+	seq := d.ReserveSeq()
+	return seq, d.SendSeq(com, param, seq, data)
+}
+
+//Take the next sequence number without writing anything. Never waits for
+//a write in progress, so it can be used while holding locks the reader needs.
+func (d *EKReceiver) ReserveSeq() int32 {
+	d.smu.Lock()
+	defer d.smu.Unlock()
+	seq := d.sequencenr
+	d.sequencenr++
+	return seq
+}
+
+//Send command to unit with a sequence number from ReserveSeq
+func (d *EKReceiver) SendSeq(com Command, param int32, seq int32, data []byte) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	if !d.connected {
+		return errNotConnected
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, &EKHeader{2, com, int32(len(data)), param, seq, 0, 0})
+	buf.Write(data)
+	_, err := d.conn.Write(buf.Bytes())
+	return err
+}
+
+//Log stale and flatline channels
+func (d *EKReceiver) watch() {
+	t := time.NewTicker(WATCHDOG_INTERVAL)
+	for now := range t.C {
+		for _, c := range d.Watchdog.Check(now) {
+			if c.To == CONDITION_OK {
+				log.Printf("Unit %s channel %d: %s cleared\n", d.addr, c.Channel, c.From)
+			} else {
+				log.Printf("Unit %s channel %d: %s\n", d.addr, c.Channel, c.To)
+			}
+		}
+	}
+}
+
+//Init set up everything needed for receiving data.
+func NewEKReceiver(addr string) *EKReceiver {
+	return NewEKReceiverProfile(addr, DefaultProfile)
+}
+
+//Set up receiver for unit model p
+func NewEKReceiverProfile(addr string, p *DeviceProfile) *EKReceiver {
+	d := new(EKReceiver)
+	d.addr = addr
+	d.Profile = p
+	d.FIRTaps = 400
+	d.SampleTime = 1000 * time.Millisecond
+	d.calc_chan = make(chan EKChannelData, 100)   //Value calculations
+	d.buffer_chan = make(chan EKChannelData, 100) //Value buffer
+	d.ValueBufferRaw = make([]*ring.Ring, p.Channels)          //Should be faster and smaller then a map
+	d.ValueBuffer = make([]*ring.Ring, p.Channels)             //Should be faster and smaller then a map
+	d.AdjustmentTable = make([]AdjustmentTable, p.Channels)    //Should be faster and smaller then a map
+	d.SiteAdjustment = make([]*SiteCalibration, p.Channels)
+	d.Gaps = NewSampleTracker(p.Channels)
+	d.Watchdog = NewWatchdog(p.Channels, p.LSB()*p.LSB())
+	go valueCalc(d)                                    // Send calculated values to buffer
+	go valueBuffer(d) // Buffer Storage
+	go d.watch()
+	//Send "Ping" Packets
+	go func() {
+		t := time.NewTicker(10 * time.Second)
+		for {
+			syncreq := new(bytes.Buffer)
+			binary.Write(syncreq, binary.BigEndian, &SyncRequest{Time: time.Now().UnixNano()})
+			d.Send(CMD_SYNC, 0, syncreq.Bytes())
+			<-t.C
+		}
+	}()
+	return d
+}
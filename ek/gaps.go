@@ -0,0 +1,167 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Gap, duplicate and out of order detection for sample timestamps.
+// Timestamps are the low 32 bits of the unit clock (microseconds), so
+// differences are taken modulo 2**32 and wraps need no special care.
+// A restarted unit can not be told from a gap or a late sample by the
+// timestamps alone, so restarts are reported by the receiver from the
+// sync replies (see DeviceClock.Add) and new connections start over.
+
+package ek
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	GAP_INTERVALS  = 1.5 //A sample this many intervals after the last means samples are missing
+	INTERVAL_LEARN = 10  //Smallest of the first intervals is taken as the sample interval
+)
+
+type SampleStatus int
+
+const (
+	SAMPLE_OK           SampleStatus = iota
+	SAMPLE_GAP                       //Samples missing before this one
+	SAMPLE_DUPLICATE                 //Same timestamp as the last sample
+	SAMPLE_OUT_OF_ORDER              //Older than the last sample
+	SAMPLE_RESTART                   //Timestamps started over
+)
+
+func (s SampleStatus) String() string {
+	switch s {
+	case SAMPLE_OK:
+		return "ok"
+	case SAMPLE_GAP:
+		return "gap"
+	case SAMPLE_DUPLICATE:
+		return "duplicate"
+	case SAMPLE_OUT_OF_ORDER:
+		return "out of order"
+	case SAMPLE_RESTART:
+		return "restart"
+	}
+	return fmt.Sprintf("SampleStatus(%d)", int(s))
+}
+
+//Dropped samples (duplicates and out of order) are not stored
+func (s SampleStatus) Dropped() bool {
+	return s == SAMPLE_DUPLICATE || s == SAMPLE_OUT_OF_ORDER
+}
+
+type GapCounters struct {
+	Samples    uint64
+	Gaps       uint64
+	Missing    uint64 //Samples estimated missing in gaps
+	Duplicates uint64
+	OutOfOrder uint64
+	Restarts   uint64
+}
+
+type channelTracker struct {
+	started  bool
+	restart  bool //Unit restarted, next sample starts over
+	last     uint32
+	interval uint32 //Expected interval, microseconds. 0 until learned
+	learned  int
+	counters GapCounters
+}
+
+//Checks sample timestamps per channel
+type SampleTracker struct {
+	mu       sync.Mutex
+	channels []channelTracker
+}
+
+func NewSampleTracker(channels int) *SampleTracker {
+	return &SampleTracker{channels: make([]channelTracker, channels)}
+}
+
+//Check timestamp of next sample on channel. Returns status and the
+//estimated number of missing samples for SAMPLE_GAP.
+func (t *SampleTracker) Check(ch uint8, ts uint32) (SampleStatus, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := &t.channels[ch]
+	if !c.started || c.restart {
+		status := SAMPLE_OK
+		if c.restart {
+			status = SAMPLE_RESTART
+			c.counters.Restarts++
+			c.interval = 0 //Sample rate may have changed
+			c.learned = 0
+		}
+		c.started = true
+		c.restart = false
+		c.last = ts
+		c.counters.Samples++
+		return status, 0
+	}
+	delta := int32(ts - c.last)
+	switch {
+	case delta == 0:
+		c.counters.Duplicates++
+		return SAMPLE_DUPLICATE, 0
+	case delta < 0:
+		c.counters.OutOfOrder++
+		return SAMPLE_OUT_OF_ORDER, 0
+	}
+	c.last = ts
+	c.counters.Samples++
+	if c.learned < INTERVAL_LEARN {
+		if c.interval == 0 || uint32(delta) < c.interval {
+			c.interval = uint32(delta)
+		}
+		c.learned++
+		return SAMPLE_OK, 0
+	}
+	if float64(delta) > GAP_INTERVALS*float64(c.interval) {
+		missing := uint64((uint32(delta)+c.interval/2)/c.interval) - 1
+		c.counters.Gaps++
+		c.counters.Missing += missing
+		return SAMPLE_GAP, missing
+	}
+	return SAMPLE_OK, 0
+}
+
+//New connection. The next sample on each channel is taken as the first,
+//samples sent while disconnected are not counted as missing.
+func (t *SampleTracker) Reconnect() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.channels {
+		t.channels[i].started = false
+	}
+}
+
+//Unit restarted. The next sample on each channel starts over and is
+//reported as SAMPLE_RESTART.
+func (t *SampleTracker) Restart() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.channels {
+		t.channels[i].restart = true
+	}
+}
+
+//Expected sample interval for channel. 0 until known.
+func (t *SampleTracker) Interval(ch uint8) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.channels[ch].interval) * time.Microsecond
+}
+
+//Counters by channel
+func (t *SampleTracker) Counters() []GapCounters {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counters := make([]GapCounters, len(t.channels))
+	for i := range t.channels {
+		counters[i] = t.channels[i].counters
+	}
+	return counters
+}
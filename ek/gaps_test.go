@@ -0,0 +1,95 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ek
+
+import "testing"
+
+func TestSampleTracker(t *testing.T) {
+	type step struct {
+		ts      uint32
+		status  SampleStatus
+		missing uint64
+	}
+	//Ten samples 10ms apart to learn the interval
+	learn := func(from uint32) []step {
+		steps := make([]step, INTERVAL_LEARN+1)
+		for i := range steps {
+			steps[i] = step{from + uint32(i)*10000, SAMPLE_OK, 0}
+		}
+		return steps
+	}
+	const last = 100000 //Last timestamp of learn(0)
+	tests := []struct {
+		name     string
+		steps    []step
+		restart  bool //Tracker.Restart before the last step
+		counters GapCounters
+	}{
+		{"ok", append(learn(0), step{last + 10000, SAMPLE_OK, 0}),
+			false, GapCounters{Samples: 12}},
+		{"jitter", append(learn(0), step{last + 14000, SAMPLE_OK, 0}),
+			false, GapCounters{Samples: 12}},
+		{"gap", append(learn(0), step{last + 40000, SAMPLE_GAP, 3}),
+			false, GapCounters{Samples: 12, Gaps: 1, Missing: 3}},
+		{"gap over wrap", append(learn(0xffffffff-last), step{29999, SAMPLE_GAP, 2}),
+			false, GapCounters{Samples: 12, Gaps: 1, Missing: 2}},
+		{"duplicate", append(learn(0), step{last, SAMPLE_DUPLICATE, 0}),
+			false, GapCounters{Samples: 11, Duplicates: 1}},
+		{"out of order", append(learn(0), step{last - 5000, SAMPLE_OUT_OF_ORDER, 0}),
+			false, GapCounters{Samples: 11, OutOfOrder: 1}},
+		{"far back", append(learn(60000000), step{1000, SAMPLE_OUT_OF_ORDER, 0}),
+			false, GapCounters{Samples: 11, OutOfOrder: 1}},
+		//Power cycle from a high counter to near zero looks like a short step forward
+		{"restart", append(learn(0xffffffff-last), step{1000, SAMPLE_RESTART, 0}),
+			true, GapCounters{Samples: 12, Restarts: 1}},
+		{"restart backwards", append(learn(60000000), step{1000, SAMPLE_RESTART, 0}),
+			true, GapCounters{Samples: 12, Restarts: 1}},
+	}
+	for _, tt := range tests {
+		tr := NewSampleTracker(1)
+		for i, s := range tt.steps {
+			if tt.restart && i == len(tt.steps)-1 {
+				tr.Restart()
+			}
+			status, missing := tr.Check(0, s.ts)
+			if status != s.status || missing != s.missing {
+				t.Errorf("%s: sample %d (%d): got %s %d, want %s %d", tt.name, i, s.ts, status, missing, s.status, s.missing)
+			}
+		}
+		if c := tr.Counters()[0]; c != tt.counters {
+			t.Errorf("%s: counters %+v, want %+v", tt.name, c, tt.counters)
+		}
+	}
+}
+
+//Interval is learned again after a restart, a new connection keeps it and counts nothing
+func TestSampleTrackerReconnect(t *testing.T) {
+	tr := NewSampleTracker(2)
+	for ts := uint32(0); ts <= 200000; ts += 10000 {
+		tr.Check(0, ts)
+		tr.Check(1, ts)
+	}
+	tr.Reconnect()
+	if status, _ := tr.Check(0, 90000000); status != SAMPLE_OK {
+		t.Errorf("first sample after reconnect: %s", status)
+	}
+	if status, _ := tr.Check(0, 90040000); status != SAMPLE_GAP {
+		t.Errorf("interval lost on reconnect: %s", status)
+	}
+	tr.Restart()
+	if status, _ := tr.Check(1, 500); status != SAMPLE_RESTART {
+		t.Errorf("first sample after restart: %s", status)
+	}
+	if tr.Interval(1) != 0 {
+		t.Errorf("interval kept after restart: %v", tr.Interval(1))
+	}
+	if status, _ := tr.Check(1, 40500); status != SAMPLE_OK {
+		t.Errorf("gap before the interval is learned: %s", status)
+	}
+	c := tr.Counters()
+	if c[0].Restarts != 0 || c[0].Missing != 3 || c[1].Restarts != 1 || c[1].Gaps != 0 {
+		t.Errorf("counters %+v", c)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Device profiles for ExpertKey / Message units
+
+package ek
+
+import "strings"
+
+//What differs between unit models
+type DeviceProfile struct {
+	Name         string
+	Models       []string  //Model strings reported by the unit (unit info or calibration Hardware)
+	Channels     int       //Analog channels
+	ChannelShift uint      //Channel number position in sample word
+	ChannelBits  uint      //Channel number width
+	ValueBits    uint      //Value width. Low bits of sample word, two's complement
+	RawMax       float64   //Raw value at ENG_MAX after left justifying value to 32 bit
+	Range        float64   //Measuring range used for adjustment table
+	Ranges       []float64 //Measuring ranges with adjustment data
+	SampleRates  []float64 //Hz
+
+	//Scaling of adjustment coefficients by order, per measuring range. The unit
+	//stores higher order coefficients scaled. Ranges not listed can not be used.
+	CoefficientScale map[float64][]float64
+}
+
+var EK200C = &DeviceProfile{
+	Name:         "ExpertKey 200C",
+	Models:       []string{"UNE200", "MOKA4"},
+	Channels:     31,
+	ChannelShift: 27,
+	ChannelBits:  5,
+	ValueBits:    23,
+	RawMax:       2084935581, //2**32/1.03/2 (Signed)
+	Range:        10,
+	Ranges:       []float64{0.1, 0.2, 0.5, 1, 2, 5, 10},
+	SampleRates:  []float64{1, 50, 100},
+	//Found by comparing with DataService
+	CoefficientScale: map[float64][]float64{
+		10: {1, 1, 1e-9, 1e-13},
+	},
+}
+
+//Used when the model is unknown
+var DefaultProfile = EK200C
+
+var deviceProfiles = []*DeviceProfile{EK200C}
+
+//Add profile for another model
+func RegisterProfile(p *DeviceProfile) {
+	deviceProfiles = append(deviceProfiles, p)
+}
+
+//Profile for model. nil if unknown.
+func LookupProfile(model string) *DeviceProfile {
+	for _, p := range deviceProfiles {
+		for _, m := range p.Models {
+			if strings.EqualFold(m, model) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+//Channel number from sample word
+func (p *DeviceProfile) Channel(word uint32) uint8 {
+	return uint8((word >> p.ChannelShift) & (1<<p.ChannelBits - 1))
+}
+
+//Value from sample word, left justified to 32 bit
+func (p *DeviceProfile) RawValue(word uint32) int32 {
+	return int32(word << (32 - p.ValueBits))
+}
+
+//One ADC step in mV, about 2.5uV at 10V range
+func (p *DeviceProfile) LSB() float64 {
+	return float64(uint32(1)<<(32-p.ValueBits)) / p.RawMax * ENG_MAX
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Data quality flags carried with every value.
+// The measuring range is +-10V, the ADC saturates at about 10.3V (parse.pl).
+// An open thermocouple leaves the input floating and it reads close to 0mV,
+// but so does a real input at 0mV. Open circuit is only flagged on channels
+// given a threshold, see ParseOpenCircuit.
+
+package ek
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const STALE_AFTER = 30 * time.Second //Newest value older than this is stale
+
+type Quality uint8
+
+const QUALITY_GOOD Quality = 0
+
+const (
+	QUALITY_OVER_RANGE   Quality = 1 << iota //Above measuring range
+	QUALITY_UNDER_RANGE                      //Below measuring range
+	QUALITY_OPEN_CIRCUIT                     //Suspected open input
+	QUALITY_INTERPOLATED                     //Filtered across missing samples
+	QUALITY_STALE                            //No newer value for STALE_AFTER
+	QUALITY_UNCALIBRATED                     //No factory adjustment for channel
+	QUALITY_FLATLINE                         //Value stuck, see watchdog.go
+)
+
+var qualityNames = []struct {
+	q    Quality
+	name string
+}{
+	{QUALITY_OVER_RANGE, "over-range"},
+	{QUALITY_UNDER_RANGE, "under-range"},
+	{QUALITY_OPEN_CIRCUIT, "open-circuit"},
+	{QUALITY_INTERPOLATED, "interpolated"},
+	{QUALITY_STALE, "stale"},
+	{QUALITY_UNCALIBRATED, "uncalibrated"},
+	{QUALITY_FLATLINE, "flatline"},
+}
+
+func (q Quality) Good() bool {
+	return q == QUALITY_GOOD
+}
+
+//Flag names separated by comma, "good" if there are none
+func (q Quality) String() string {
+	if q.Good() {
+		return "good"
+	}
+	var names []string
+	for _, n := range qualityNames {
+		if q&n.q != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+//Quality is written as its name in JSON
+func (q Quality) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+//Range flags for an unadjusted value in mV
+func RangeQuality(v float64) Quality {
+	switch {
+	case v > ENG_MAX:
+		return QUALITY_OVER_RANGE
+	case v < ENG_MIN:
+		return QUALITY_UNDER_RANGE
+	}
+	return QUALITY_GOOD
+}
+
+//Open input flag for an unadjusted value in mV. threshold 0 never flags.
+func OpenCircuitQuality(v, threshold float64) Quality {
+	if v > -threshold && v < threshold {
+		return QUALITY_OPEN_CIRCUIT
+	}
+	return QUALITY_GOOD
+}
+
+//Per channel open circuit thresholds in mV from "channel:mV,...", as
+//"3:0.05,4:0.05". Channels not listed are not checked.
+func ParseOpenCircuit(s string, channels int) ([]float64, error) {
+	thresholds := make([]float64, channels)
+	if err := parseThresholds(s, "open circuit", "mV", thresholds); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+//Per channel flatline thresholds in mV**2 from "channel:variance,...", as
+//"3:1e-4,4:0". Channels not listed get def, 0 disables the check.
+func ParseFlatline(s string, channels int, def float64) ([]float64, error) {
+	thresholds := make([]float64, channels)
+	for i := range thresholds {
+		thresholds[i] = def
+	}
+	if err := parseThresholds(s, "flatline", "variance", thresholds); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+//Set thresholds from "channel:value,...". Values must not be negative.
+func parseThresholds(s, what, unit string, thresholds []float64) error {
+	if s == "" {
+		return nil
+	}
+	for _, f := range strings.Split(s, ",") {
+		p := strings.SplitN(strings.TrimSpace(f), ":", 2)
+		if len(p) != 2 {
+			return fmt.Errorf("%s: want channel:%s, got %q", what, unit, f)
+		}
+		ch, err := strconv.Atoi(p[0])
+		if err != nil || ch < 0 || ch >= len(thresholds) {
+			return fmt.Errorf("%s: bad channel %q", what, p[0])
+		}
+		v, err := strconv.ParseFloat(p[1], 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s: bad threshold %q", what, p[1])
+		}
+		thresholds[ch] = v
+	}
+	return nil
+}
+
+//Quality of cd as the newest value of its buffer, read at now
+func (cd ChannelData) QualityAt(now time.Time) Quality {
+	if now.Sub(cd.Timestamp) > STALE_AFTER {
+		return cd.Quality | QUALITY_STALE
+	}
+	return cd.Quality
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Session recordings in the replay format written by ekspy and read by ekdecode.
+
+package ek
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+//Replay format:
+//
+//	"EKREC1\n\x00" followed by records of
+//	int64 time (UnixNano) | uint8 direction | uint32 length | frame (header + data)
+//
+//All big endian.
+const RECORD_MAGIC = "EKREC1\n\x00"
+
+const MAX_FRAME = 16 << 20 //Larger frames means we lost track of the stream
+
+const (
+	TO_UNIT   = 0 //Client -> unit
+	FROM_UNIT = 1 //Unit -> client
+)
+
+var ErrBadRecording = errors.New("not a recording")
+
+//One frame as seen by ekspy
+type Record struct {
+	Time      time.Time
+	Direction uint8
+	Frame     []byte
+}
+
+type RecordWriter struct {
+	w *bufio.Writer
+}
+
+func NewRecordWriter(w io.Writer) (*RecordWriter, error) {
+	r := &RecordWriter{bufio.NewWriter(w)}
+	if _, err := r.w.WriteString(RECORD_MAGIC); err != nil {
+		return nil, err
+	}
+	return r, r.w.Flush()
+}
+
+func (r *RecordWriter) Write(rec Record) error {
+	var head [13]byte
+	binary.BigEndian.PutUint64(head[0:], uint64(rec.Time.UnixNano()))
+	head[8] = rec.Direction
+	binary.BigEndian.PutUint32(head[9:], uint32(len(rec.Frame)))
+	r.w.Write(head[:])
+	r.w.Write(rec.Frame)
+	return r.w.Flush()
+}
+
+type RecordReader struct {
+	r *bufio.Reader
+}
+
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(RECORD_MAGIC))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != RECORD_MAGIC {
+		return nil, ErrBadRecording
+	}
+	return &RecordReader{br}, nil
+}
+
+//Next record. io.EOF at end of recording.
+func (r *RecordReader) Read() (Record, error) {
+	var rec Record
+	var head [13]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		return rec, err
+	}
+	rec.Time = time.Unix(0, int64(binary.BigEndian.Uint64(head[0:])))
+	rec.Direction = head[8]
+	n := binary.BigEndian.Uint32(head[9:])
+	if n > MAX_FRAME {
+		return rec, ErrBadRecording
+	}
+	rec.Frame = make([]byte, n)
+	if _, err := io.ReadFull(r.r, rec.Frame); err != nil {
+		return rec, io.ErrUnexpectedEOF
+	}
+	return rec, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ek
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	recs := []Record{
+		{Time: start, Direction: TO_UNIT, Frame: []byte{0, 2, 0, 1, 2, 3}},
+		{Time: start.Add(1500 * time.Microsecond), Direction: FROM_UNIT, Frame: bytes.Repeat([]byte{0xaa}, 3000)},
+		{Time: start.Add(time.Second), Direction: FROM_UNIT, Frame: []byte{}},
+	}
+	var buf bytes.Buffer
+	w, err := NewRecordWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := w.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := NewRecordReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range recs {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("record %d: %s", i, err)
+		}
+		if !got.Time.Equal(want.Time) || got.Direction != want.Direction || !bytes.Equal(got.Frame, want.Frame) {
+			t.Errorf("record %d: got %v %d %d bytes, want %v %d %d bytes", i,
+				got.Time, got.Direction, len(got.Frame), want.Time, want.Direction, len(want.Frame))
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("after last record: got %v, want EOF", err)
+	}
+
+	//Drop the last record and the last byte of the second frame
+	r, _ = NewRecordReader(bytes.NewReader(buf.Bytes()[:buf.Len()-13-1]))
+	r.Read()
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestRecordBadMagic(t *testing.T) {
+	for _, in := range []string{"", "EKREC", "EKREC2\n\x00", "0002000100000000"} {
+		if _, err := NewRecordReader(bytes.NewReader([]byte(in))); err != ErrBadRecording {
+			t.Errorf("%q: got %v, want ErrBadRecording", in, err)
+		}
+	}
+}
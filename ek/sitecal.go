@@ -0,0 +1,186 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Site calibration. Offset and gain from a two-point field check,
+// applied on top of the factory adjustment.
+
+package ek
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const MAX_SITE_GAIN_ERROR = 0.1 //Field gain must be within 1 +- this
+
+const SITECAL_FILE = "data/sitecal.json" //Default record file for web, stream and ekcal
+
+const SITECAL_RELOAD = time.Minute //Receivers reread the records this often
+
+//Value reported by the unit and value read on the reference instrument
+type CalibrationPoint struct {
+	Measured  float64
+	Reference float64
+}
+
+//One field calibration record. Records are never changed or removed,
+//a new record replaces the old one from its date.
+type SiteCalibration struct {
+	ID         int    //Number in the store, from 1
+	Replaces   int    `json:",omitempty"` //ID of the record in effect when the points were taken
+	Unit       string //Unit serial
+	Channel    int
+	Offset     float64
+	Gain       float64
+	Date       time.Time
+	Technician string
+	Reference  string             //Reference instrument
+	Points     []CalibrationPoint //As reported, with the record in effect at the time applied
+	Comment    string             `json:",omitempty"`
+}
+
+//Compute offset and gain that maps measured values onto reference values
+func TwoPointCalibration(p1, p2 CalibrationPoint) (offset, gain float64, err error) {
+	if p1.Measured == p2.Measured {
+		return 0, 1, fmt.Errorf("site calibration: points must have different measured values")
+	}
+	gain = (p2.Reference - p1.Reference) / (p2.Measured - p1.Measured)
+	if math.IsNaN(gain) || math.IsInf(gain, 0) || math.Abs(gain-1) > MAX_SITE_GAIN_ERROR {
+		return 0, 1, fmt.Errorf("site calibration: implausible gain %g", gain)
+	}
+	offset = p1.Reference - gain*p1.Measured
+	return offset, gain, nil
+}
+
+//Offset and gain from points taken while active was in effect. Measured values are
+//taken back to uncorrected values first, so the result replaces active instead of
+//being applied on top of it. active may be nil.
+func ComposeSiteCalibration(active *SiteCalibration, p1, p2 CalibrationPoint) (offset, gain float64, err error) {
+	if active != nil {
+		p1.Measured = active.Unapply(p1.Measured)
+		p2.Measured = active.Unapply(p2.Measured)
+	}
+	return TwoPointCalibration(p1, p2)
+}
+
+//Corrected value
+func (s *SiteCalibration) Apply(v float64) float64 {
+	return s.Offset + s.Gain*v
+}
+
+//Uncorrected value. Inverse of Apply.
+func (s *SiteCalibration) Unapply(v float64) float64 {
+	return (v - s.Offset) / s.Gain
+}
+
+func (s *SiteCalibration) String() string {
+	return fmt.Sprintf("#%d %s/%d: offset %g gain %g (%s by %s, reference %s)", s.ID, s.Unit, s.Channel, s.Offset, s.Gain, s.Date.Format(time.RFC3339), s.Technician, s.Reference)
+}
+
+//Time a record was in effect. To is zero for the record in effect now.
+type SiteCalibrationPeriod struct {
+	SiteCalibration
+	From time.Time
+	To   time.Time
+}
+
+//Site calibration records for all units, kept in a JSON file
+type SiteCalibrationStore struct {
+	File string
+}
+
+func NewSiteCalibrationStore(file string) *SiteCalibrationStore {
+	return &SiteCalibrationStore{File: file}
+}
+
+//Returns all records. A missing file is not an error.
+func (s *SiteCalibrationStore) Load() ([]SiteCalibration, error) {
+	b, err := ioutil.ReadFile(s.File)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []SiteCalibration
+	if err = json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	//Records are never removed, so the position is the ID of records written without one
+	for i := range records {
+		if records[i].ID == 0 {
+			records[i].ID = i + 1
+		}
+	}
+	return records, nil
+}
+
+//Append record to the store and set its ID
+func (s *SiteCalibrationStore) Add(c *SiteCalibration) error {
+	records, err := s.Load()
+	if err != nil {
+		return err
+	}
+	c.ID = len(records) + 1
+	records = append(records, *c)
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.File)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(dir, "sitecal")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(b); err != nil {
+		fh.Close()
+		os.Remove(fh.Name())
+		return err
+	}
+	if err = fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	return os.Rename(fh.Name(), s.File)
+}
+
+//Records in effect for unit at time t, indexed by channel. nil where there is none.
+func ActiveSiteCalibration(records []SiteCalibration, unit string, channels int, t time.Time) []*SiteCalibration {
+	active := make([]*SiteCalibration, channels)
+	for i := range records {
+		r := &records[i]
+		if r.Unit != unit || r.Channel < 0 || r.Channel >= channels || r.Date.After(t) {
+			continue
+		}
+		if active[r.Channel] == nil || !r.Date.Before(active[r.Channel].Date) {
+			active[r.Channel] = r
+		}
+	}
+	return active
+}
+
+//Records for unit and channel in the order they took effect, with the time each was in effect
+func SiteCalibrationHistory(records []SiteCalibration, unit string, channel int) []SiteCalibrationPeriod {
+	var history []SiteCalibrationPeriod
+	for _, r := range records {
+		if r.Unit == unit && r.Channel == channel {
+			history = append(history, SiteCalibrationPeriod{SiteCalibration: r, From: r.Date})
+		}
+	}
+	//Stable, a later record with the same date wins as in ActiveSiteCalibration
+	sort.SliceStable(history, func(i, j int) bool { return history[i].From.Before(history[j].From) })
+	for i := 0; i+1 < len(history); i++ {
+		history[i].To = history[i+1].From
+	}
+	return history
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ek
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Two field checks in a row. The second is read with the first in effect.
+func TestSiteCalibrationConsecutive(t *testing.T) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	//Reference instrument reading for factory adjusted value v at each check
+	drift := []struct {
+		offset, gain float64
+	}{
+		{2, 1.01},
+		{3, 1.02},
+	}
+	var records []SiteCalibration
+	for i, d := range drift {
+		now := start.Add(time.Duration(i) * 24 * time.Hour)
+		active := ActiveSiteCalibration(records, "X", 1, now)[0]
+		var points [2]CalibrationPoint
+		for j, v := range []float64{100, 1000} {
+			points[j] = CalibrationPoint{Measured: v, Reference: d.offset + d.gain*v}
+			if active != nil {
+				points[j].Measured = active.Apply(v)
+			}
+		}
+		offset, gain, err := ComposeSiteCalibration(active, points[0], points[1])
+		if err != nil {
+			t.Fatalf("check %d: %s", i, err)
+		}
+		if math.Abs(offset-d.offset) > 1e-9 || math.Abs(gain-d.gain) > 1e-9 {
+			t.Errorf("check %d: got offset %g gain %g, want %g %g", i, offset, gain, d.offset, d.gain)
+		}
+		records = append(records, SiteCalibration{Unit: "X", Channel: 0, Offset: offset, Gain: gain, Date: now})
+	}
+	s := ActiveSiteCalibration(records, "X", 1, start.Add(48*time.Hour))[0]
+	for _, v := range []float64{-5000, 0, 250, 9000} {
+		if got, want := s.Apply(v), 3+1.02*v; math.Abs(got-want) > 1e-9 {
+			t.Errorf("Apply(%g) = %g, want %g", v, got, want)
+		}
+		if got := s.Unapply(s.Apply(v)); math.Abs(got-v) > 1e-9 {
+			t.Errorf("Unapply(Apply(%g)) = %g", v, got)
+		}
+	}
+}
+
+func TestSiteCalibrationHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sitecal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewSiteCalibrationStore(filepath.Join(dir, "sitecal.json"))
+	day := func(d int) time.Time { return time.Date(2015, 6, d, 0, 0, 0, 0, time.UTC) }
+	for _, c := range []SiteCalibration{
+		{Unit: "X", Channel: 0, Gain: 1, Date: day(3)},
+		{Unit: "X", Channel: 1, Gain: 1, Date: day(2)},
+		{Unit: "X", Channel: 0, Gain: 1, Date: day(1)}, //Entered late
+		{Unit: "Y", Channel: 0, Gain: 1, Date: day(2)},
+		{Unit: "X", Channel: 0, Gain: 1, Date: day(5), Replaces: 1},
+	} {
+		if err := store.Add(&c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range records {
+		if r.ID != i+1 {
+			t.Errorf("record %d: ID %d", i, r.ID)
+		}
+	}
+	history := SiteCalibrationHistory(records, "X", 0)
+	want := []struct {
+		id       int
+		from, to time.Time
+	}{
+		{3, day(1), day(3)},
+		{1, day(3), day(5)},
+		{5, day(5), time.Time{}},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("got %d periods, want %d", len(history), len(want))
+	}
+	for i, w := range want {
+		h := history[i]
+		if h.ID != w.id || !h.From.Equal(w.from) || !h.To.Equal(w.to) {
+			t.Errorf("period %d: got #%d %s - %s, want #%d %s - %s", i, h.ID, h.From, h.To, w.id, w.from, w.to)
+		}
+		if a := ActiveSiteCalibration(records, "X", 2, h.From)[0]; a == nil || a.ID != h.ID {
+			t.Errorf("period %d: active at %s is %v, want #%d", i, h.From, a, h.ID)
+		}
+	}
+}
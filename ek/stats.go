@@ -0,0 +1,115 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Connection and traffic counters for a receiver
+
+package ek
+
+import (
+	"sync"
+	"time"
+)
+
+const RATE_WINDOW = 10 * time.Second //Packet and sample rates are averaged over this
+
+type ReceiverStats struct {
+	mu          sync.Mutex
+	connects    int
+	connected   time.Time
+	lastPacket  time.Time
+	packets     uint64
+	samples     uint64
+	dropped     uint64
+	errors      uint64
+	offset      time.Duration
+	rateStart   time.Time
+	ratePackets uint64
+	rateSamples uint64
+	packetRate  float64
+	sampleRate  float64
+}
+
+//Copy of the counters
+type StatsSnapshot struct {
+	Connects     int
+	Reconnects   int
+	Connected    time.Time //Time of last connect
+	LastPacket   time.Time
+	Packets      uint64
+	Samples      uint64
+	Dropped      uint64        //Samples not used: duplicates, out of order, unknown channel
+	DecodeErrors uint64        //Frames or payloads that could not be decoded
+	PacketRate   float64       //Per second over RATE_WINDOW
+	SampleRate   float64       //Per second over RATE_WINDOW
+	ClockOffset  time.Duration //Arrival of last sample minus its time from the unit clock
+}
+
+func (s *ReceiverStats) Connect(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connects++
+	s.connected = t
+}
+
+//Count frame received at t carrying samples
+func (s *ReceiverStats) Packet(t time.Time, samples int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPacket = t
+	s.packets++
+	s.samples += uint64(samples)
+	if s.rateStart.IsZero() {
+		s.rateStart = t
+		s.ratePackets, s.rateSamples = s.packets, s.samples
+	}
+	if dt := t.Sub(s.rateStart); dt >= RATE_WINDOW {
+		s.packetRate = float64(s.packets-s.ratePackets) / dt.Seconds()
+		s.sampleRate = float64(s.samples-s.rateSamples) / dt.Seconds()
+		s.rateStart = t
+		s.ratePackets, s.rateSamples = s.packets, s.samples
+	}
+}
+
+//Count sample not used
+func (s *ReceiverStats) Drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+func (s *ReceiverStats) DecodeError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+}
+
+func (s *ReceiverStats) ClockOffset(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = d
+}
+
+func (s *ReceiverStats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := StatsSnapshot{
+		Connects:     s.connects,
+		Connected:    s.connected,
+		LastPacket:   s.lastPacket,
+		Packets:      s.packets,
+		Samples:      s.samples,
+		Dropped:      s.dropped,
+		DecodeErrors: s.errors,
+		PacketRate:   s.packetRate,
+		SampleRate:   s.sampleRate,
+		ClockOffset:  s.offset,
+	}
+	if time.Since(s.lastPacket) > RATE_WINDOW {
+		snap.PacketRate, snap.SampleRate = 0, 0 //Nothing received lately
+	}
+	if s.connects > 1 {
+		snap.Reconnects = s.connects - 1
+	}
+	return snap
+}
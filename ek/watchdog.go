@@ -0,0 +1,215 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Stale and flatline watchdog.
+// A channel is stale when no sample has arrived for STALE_AFTER and flat
+// when the samples of the last FLATLINE_WINDOW hardly vary. The ADC
+// resolution is about 2.5uV at 10V range, a working input always has some
+// noise. The default threshold is the variance of one step (DeviceProfile.LSB),
+// inputs with less noise than that can be given their own, see ParseFlatline.
+
+package ek
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	FLATLINE_WINDOW   = 10 * time.Second //Time span checked for a flatline
+	WATCHDOG_INTERVAL = 1 * time.Second
+)
+
+type Condition int
+
+const (
+	CONDITION_OK Condition = iota
+	CONDITION_STALE
+	CONDITION_FLATLINE
+)
+
+func (c Condition) String() string {
+	switch c {
+	case CONDITION_STALE:
+		return "stale"
+	case CONDITION_FLATLINE:
+		return "flatline"
+	}
+	return "ok"
+}
+
+//Condition is written as its name in JSON
+func (c Condition) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c Condition) Quality() Quality {
+	switch c {
+	case CONDITION_STALE:
+		return QUALITY_STALE
+	case CONDITION_FLATLINE:
+		return QUALITY_FLATLINE
+	}
+	return QUALITY_GOOD
+}
+
+//Channel state as seen by the watchdog
+type ChannelHealth struct {
+	Channel    int
+	LastSample time.Time //Zero if no sample has arrived
+	Age        time.Duration
+	Variance   float64 //Over the last FLATLINE_WINDOW, mV**2
+	Samples    int     //Samples in window
+	Flatline   float64 //Variance threshold, mV**2. 0 if not checked
+	Condition  Condition
+}
+
+//Condition raised or cleared on a channel
+type ConditionChange struct {
+	Channel int
+	From    Condition
+	To      Condition
+}
+
+type watchSample struct {
+	t time.Time
+	v float64
+}
+
+type watchChannel struct {
+	last      time.Time
+	first     time.Time     //First sample since the window was last empty
+	window    []watchSample //Samples of the last FLATLINE_WINDOW, oldest first
+	flatline  float64       //Variance threshold, mV**2. 0 disables
+	condition Condition
+}
+
+func (c *watchChannel) variance() float64 {
+	n := len(c.window)
+	if n < 2 {
+		return 0
+	}
+	mean := float64(0)
+	for _, s := range c.window {
+		mean += s.v
+	}
+	mean /= float64(n)
+	sum := float64(0)
+	for _, s := range c.window {
+		sum += (s.v - mean) * (s.v - mean)
+	}
+	return sum / float64(n)
+}
+
+//Drop samples older than FLATLINE_WINDOW before now
+func (c *watchChannel) trim(now time.Time) {
+	i := 0
+	for i < len(c.window) && now.Sub(c.window[i].t) > FLATLINE_WINDOW {
+		i++
+	}
+	c.window = c.window[i:]
+	if len(c.window) == 0 {
+		c.first = time.Time{}
+	}
+}
+
+//Samples have covered the whole window and do not vary
+func (c *watchChannel) flat(now time.Time) bool {
+	return c.flatline > 0 && !c.first.IsZero() && now.Sub(c.first) >= FLATLINE_WINDOW &&
+		len(c.window) >= 2 && c.variance() < c.flatline
+}
+
+//Tracks time since last sample and variance per channel
+type Watchdog struct {
+	mu       sync.Mutex
+	started  time.Time
+	channels []watchChannel
+}
+
+//flatline is the variance threshold in mV**2 for all channels, see SetFlatline
+func NewWatchdog(channels int, flatline float64) *Watchdog {
+	w := &Watchdog{started: time.Now(), channels: make([]watchChannel, channels)}
+	for i := range w.channels {
+		w.channels[i].flatline = flatline
+	}
+	return w
+}
+
+//Per channel variance thresholds in mV**2, see ParseFlatline. 0 disables.
+func (w *Watchdog) SetFlatline(thresholds []float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.channels {
+		if i < len(thresholds) {
+			w.channels[i].flatline = thresholds[i]
+		}
+	}
+}
+
+//Add sample. Returns QUALITY_FLATLINE if the channel was flat at the last Check.
+func (w *Watchdog) Sample(ch uint8, t time.Time, v float64) Quality {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := &w.channels[ch]
+	c.last = t
+	if c.first.IsZero() {
+		c.first = t
+	}
+	c.window = append(c.window, watchSample{t, v})
+	c.trim(t)
+	if c.condition == CONDITION_FLATLINE {
+		return QUALITY_FLATLINE
+	}
+	return QUALITY_GOOD
+}
+
+//Update conditions. Returns the channels that changed.
+func (w *Watchdog) Check(now time.Time) []ConditionChange {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var changes []ConditionChange
+	for i := range w.channels {
+		c := &w.channels[i]
+		cond := CONDITION_OK
+		last := c.last
+		if last.IsZero() {
+			last = w.started
+		}
+		c.trim(now)
+		switch {
+		case now.Sub(last) > STALE_AFTER:
+			cond = CONDITION_STALE
+		case c.flat(now):
+			cond = CONDITION_FLATLINE
+		}
+		if cond != c.condition {
+			changes = append(changes, ConditionChange{i, c.condition, cond})
+			c.condition = cond
+		}
+	}
+	return changes
+}
+
+//Condition of channel as of the last Check
+func (w *Watchdog) Condition(ch uint8) Condition {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.channels[ch].condition
+}
+
+//Health of all channels at now
+func (w *Watchdog) Status(now time.Time) []ChannelHealth {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	health := make([]ChannelHealth, len(w.channels))
+	for i := range w.channels {
+		c := &w.channels[i]
+		c.trim(now)
+		health[i] = ChannelHealth{Channel: i, LastSample: c.last, Variance: c.variance(), Samples: len(c.window), Flatline: c.flatline, Condition: c.condition}
+		if !c.last.IsZero() {
+			health[i].Age = now.Sub(c.last)
+		}
+	}
+	return health
+}
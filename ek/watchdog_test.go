@@ -0,0 +1,83 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ek
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFlatline(t *testing.T) {
+	lsb := EK200C.LSB()
+	if math.Abs(lsb-0.002456) > 1e-6 {
+		t.Errorf("LSB %g mV, want about 2.46uV", lsb)
+	}
+	constant := func(i int) float64 { return 1234.5 }
+	toggle := func(i int) float64 { return 1234.5 + float64(i%2)*2*lsb } //Variance of 1 LSB**2
+	tests := []struct {
+		name     string
+		value    func(int) float64
+		rate     time.Duration //Between samples
+		span     time.Duration //Time from first to last sample
+		flatline float64
+		want     Condition
+	}{
+		{"constant", constant, 10 * time.Millisecond, 11 * time.Second, lsb * lsb, CONDITION_FLATLINE},
+		{"constant 1Hz", constant, time.Second, 11 * time.Second, lsb * lsb, CONDITION_FLATLINE},
+		{"constant short", constant, 10 * time.Millisecond, 5 * time.Second, lsb * lsb, CONDITION_OK},
+		{"one step noise", toggle, 10 * time.Millisecond, 11 * time.Second, lsb * lsb, CONDITION_OK},
+		{"quiet input", toggle, 10 * time.Millisecond, 11 * time.Second, 2 * lsb * lsb, CONDITION_FLATLINE},
+		{"disabled", constant, 10 * time.Millisecond, 11 * time.Second, 0, CONDITION_OK},
+	}
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		w := NewWatchdog(2, lsb*lsb)
+		w.SetFlatline([]float64{tt.flatline})
+		now := start
+		for i := 0; now.Sub(start) <= tt.span; i++ {
+			w.Sample(0, now, tt.value(i))
+			now = now.Add(tt.rate)
+		}
+		w.Check(now)
+		if got := w.Condition(0); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+		if got := w.Condition(1); got != CONDITION_OK {
+			t.Errorf("%s: channel without samples is %s before STALE_AFTER", tt.name, got)
+		}
+		if h := w.Status(now)[0]; h.Flatline != tt.flatline {
+			t.Errorf("%s: status threshold %g, want %g", tt.name, h.Flatline, tt.flatline)
+		}
+	}
+}
+
+//Samples older than the window are forgotten, a channel that starts varying is no longer flat
+func TestFlatlineRecovers(t *testing.T) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	w := NewWatchdog(1, EK200C.LSB()*EK200C.LSB())
+	now := start
+	for ; now.Sub(start) <= 20*time.Second; now = now.Add(100 * time.Millisecond) {
+		w.Sample(0, now, 5)
+	}
+	w.Check(now)
+	if w.Condition(0) != CONDITION_FLATLINE {
+		t.Fatalf("constant input is %s", w.Condition(0))
+	}
+	if q := w.Sample(0, now, 5); q != QUALITY_FLATLINE {
+		t.Errorf("sample on flat channel: %s", q)
+	}
+	for i := 0; i < 100; i++ {
+		w.Sample(0, now, 5+float64(i%7))
+		now = now.Add(100 * time.Millisecond)
+	}
+	w.Check(now)
+	if w.Condition(0) != CONDITION_OK {
+		t.Errorf("varying input is %s", w.Condition(0))
+	}
+	if n := w.Status(now)[0].Samples; n > 101 {
+		t.Errorf("%d samples in window, want at most 10s worth", n)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tool for looking at the Calibration element of ExpertKey calibration replies.
+// Reads a calibration reply (as kept by the calibration store) or plain Base64.
+
+package main
+
+import (
+	"bytes"
+	"delphin/ek"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+var hexdump = flag.Bool("hex", false, "Hex dump the compressed blob")
+var dumpxml = flag.Bool("xml", false, "Print the decompressed certificate XML")
+var checks = flag.Bool("checks", false, "List every check in the certificate")
+var channel = flag.Int("channel", -1, "Only list checks for channel")
+
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+//Returns the Base64 text and the calibration if the input was a calibration reply
+func readInput(b []byte) (string, *ek.Calibration) {
+	if i := bytes.Index(b, []byte("<Default")); i >= 0 {
+		calib, err := ek.NewCalibration(b[i:])
+		if err != nil {
+			fail("%s", err)
+		}
+		return calib.Calibration, calib
+	}
+	return string(b), nil
+}
+
+func main() {
+	flag.Parse()
+	var b []byte
+	var err error
+	if flag.NArg() > 0 {
+		b, err = ioutil.ReadFile(flag.Arg(0))
+	} else {
+		b, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fail("%s", err)
+	}
+	text, calib := readInput(b)
+	blob, err := ek.CalibrationBlob(text)
+	if err != nil {
+		fail("Base64: %s", err)
+	}
+	if *hexdump {
+		fmt.Print(hex.Dump(blob))
+		return
+	}
+	if *dumpxml {
+		x, err := ek.DecompressCalibrationBlob(blob)
+		if err != nil {
+			fail("Decompress: %s", err)
+		}
+		os.Stdout.Write(x)
+		fmt.Println()
+		return
+	}
+
+	fmt.Printf("Base64:      %d bytes\n", len(text))
+	fmt.Printf("Blob:        %d bytes\n", len(blob))
+	if len(blob) >= 4 {
+		fmt.Printf("Length:      %d (%s, little endian)\n", binary.LittleEndian.Uint32(blob), hex.EncodeToString(blob[:4]))
+	}
+	if calib != nil {
+		a := calib.Adjustment
+		fmt.Printf("Adjustment:  %s %s %s by %s, %d entries\n", a.Date, a.Hardware, a.Software, a.User, len(a.Data))
+	}
+	x, err := ek.DecompressCalibrationBlob(blob)
+	if err != nil {
+		n := len(blob)
+		if n > 256 {
+			n = 256
+		}
+		fmt.Printf("Decompress:  %s\n%s", err, hex.Dump(blob[:n]))
+		os.Exit(1)
+	}
+	fmt.Printf("Compression: LZO1X %d -> %d bytes (%.1f:1)\n", len(blob)-4, len(x), float64(len(x))/float64(len(blob)-4))
+
+	cert, err := ek.NewCalibrationCertificate(text)
+	if err != nil {
+		fail("Certificate: %s", err)
+	}
+	fmt.Printf("Certificate: Version %s Date %s\n", cert.Version, cert.Date)
+	fmt.Printf("Hardware:    %s Software %s\n", cert.Hardware, cert.Software)
+	fmt.Printf("Person:      %s, %s\n", cert.Person, cert.Location)
+	fmt.Printf("Serial:      not in certificate, see unit info reply (0x07)\n")
+	failed := 0
+	for _, c := range cert.Data {
+		if !c.Passed {
+			failed++
+		}
+	}
+	fmt.Printf("Checks:      %d (%d failed)\n\n", len(cert.Data), failed)
+
+	fmt.Printf("%-5s %10s %6s %6s %12s %s\n", "Unit", "Range", "Checks", "Failed", "MaxError", "Channels")
+	for _, r := range cert.Ranges() {
+		fmt.Printf("%-5s %10g %6d %6d %12.6f %v\n", r.Unit, r.Range, r.Checks, r.Failed, r.MaxError, r.Channels)
+	}
+
+	if *checks {
+		fmt.Printf("\n%-3s %-32s %10s %14s %14s %12s %10s %s\n", "Ch", "Description", "Range", "Setpoint", "Actual", "Error", "Tolerance", "Passed")
+		for _, c := range cert.Data {
+			if *channel > -1 && c.Channel != *channel {
+				continue
+			}
+			fmt.Printf("%3d %-32s %10g %14.6f %14.6f %12.6f %10g %v\n", c.Channel, c.Description, c.MeasuringRange, c.SetpointValue, c.ActualValue, c.Error(), c.Tolerance, c.Passed)
+		}
+	}
+}
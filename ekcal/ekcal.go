@@ -0,0 +1,95 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tool for site calibration of Delphin ExpertKey DAQ channels.
+// Computes offset and gain from two reference points and records who did it and with what.
+// The points are read with the current site calibration in effect, which the new record replaces.
+
+package main
+
+import (
+	"delphin/ek"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var file = flag.String("file", ek.SITECAL_FILE, "Site calibration records")
+var list = flag.Bool("list", false, "List records and exit")
+var dry = flag.Bool("n", false, "Compute correction without storing it")
+var unit = flag.String("unit", "", "Unit serial")
+var channel = flag.Int("channel", -1, "Channel")
+var m1 = flag.Float64("m1", 0, "Point 1 value reported by unit")
+var r1 = flag.Float64("r1", 0, "Point 1 value on reference instrument")
+var m2 = flag.Float64("m2", 0, "Point 2 value reported by unit")
+var r2 = flag.Float64("r2", 0, "Point 2 value on reference instrument")
+var technician = flag.String("technician", "", "Name of person doing the calibration")
+var reference = flag.String("reference", "", "Reference instrument (make, model, serial)")
+var comment = flag.String("comment", "", "Free text")
+
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+	store := ek.NewSiteCalibrationStore(*file)
+
+	if *list {
+		records, err := store.Load()
+		if err != nil {
+			fail("%s", err)
+		}
+		for i := range records {
+			if *unit == "" || records[i].Unit == *unit {
+				fmt.Printf("%s\n", &records[i])
+			}
+		}
+		return
+	}
+
+	if *unit == "" || *channel < 0 {
+		fail("-unit and -channel are required")
+	}
+	if !*dry && (*technician == "" || *reference == "") {
+		fail("-technician and -reference are required")
+	}
+	records, err := store.Load()
+	if err != nil {
+		fail("%s", err)
+	}
+	//The unit reports values with the active record applied
+	active := ek.ActiveSiteCalibration(records, *unit, *channel+1, time.Now())[*channel]
+	p1 := ek.CalibrationPoint{Measured: *m1, Reference: *r1}
+	p2 := ek.CalibrationPoint{Measured: *m2, Reference: *r2}
+	offset, gain, err := ek.ComposeSiteCalibration(active, p1, p2)
+	if err != nil {
+		fail("%s", err)
+	}
+	c := ek.SiteCalibration{
+		Unit:       *unit,
+		Channel:    *channel,
+		Offset:     offset,
+		Gain:       gain,
+		Date:       time.Now(),
+		Technician: *technician,
+		Reference:  *reference,
+		Points:     []ek.CalibrationPoint{p1, p2},
+		Comment:    *comment,
+	}
+	if active != nil {
+		fmt.Printf("Replacing %s\n", active)
+		c.Replaces = active.ID
+	}
+	fmt.Printf("%s\n", &c)
+	if *dry {
+		return
+	}
+	if err = store.Add(&c); err != nil {
+		fail("%s", err)
+	}
+	fmt.Printf("Saved as #%d to %s\n", c.ID, *file)
+}
@@ -0,0 +1,338 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command console for Delphin ExpertKey DAQs.
+// Sends arbitrary commands to a unit and prints the replies.
+// Commands are read from the terminal or from script files so
+// experiments with unknown commands can be repeated.
+//
+//	send <com> [param] [hex payload]   Raw command, com in hex (0x50 or 50)
+//	<shortcut> [param] [hex payload]   Known command, see "help"
+//	wait <duration>                    Print what arrives for a while (500ms, 2s)
+//	data on|off                        Print channel data frames
+//	run <file>                         Run script file
+//	help, quit
+//
+// Lines starting with # are comments.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"delphin/ek"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var address = flag.String("address", "192.168.251.50:1034", "ip:port to ExpertKey Device")
+var script = flag.String("script", "", "Run commands from file and exit")
+var interactive = flag.Bool("i", false, "Continue interactively after script")
+var timeout = flag.Duration("timeout", 2*time.Second, "Wait this long for a reply")
+var dump = flag.Int("dump", 256, "Hex dump at most this many payload bytes")
+
+type shortcut struct {
+	Com     ek.Command
+	Payload []byte
+	Help    string
+}
+
+//Known commands. Payload is used when none is given.
+var shortcuts = map[string]shortcut{
+	"init":    {ek.CMD_INIT, ek.DefaultInitRequest.Unknown[:], "Init session"},
+	"info":    {ek.CMD_UNIT_INFO, nil, "Unit info (serial, MAC, firmware)"},
+	"start":   {ek.CMD_START, nil, "Start streaming"},
+	"stop":    {ek.CMD_STOP, nil, "Stop streaming"},
+	"sync":    {ek.CMD_SYNC, nil, "Sync with local time"},
+	"net":     {ek.CMD_NET_INFO, nil, "Network information"},
+	"calinfo": {ek.CMD_CALIB_INFO, nil, "Calib info"},
+	"calib":   {ek.CMD_CALIBRATION, nil, "Calibration (adjustment and certificate)"},
+	"chan":    {ek.CMD_CHANNEL_INFO, nil, "Channel info?"},
+}
+
+var errUsage = errors.New("usage: send <com> [param] [hex payload]")
+
+type console struct {
+	conn net.Conn
+	seq  int32
+	data bool
+
+	mu      sync.Mutex
+	replies map[int32]chan bool //Closed when reply to seq is printed
+	sent    map[int32]time.Time
+}
+
+//Payload for sync request, local time as nanoseconds
+func syncPayload() []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, &ek.SyncRequest{Time: time.Now().UnixNano()})
+	return b.Bytes()
+}
+
+//Short description of known replies
+func describe(head ek.EKHeader, data []byte) []string {
+	var lines []string
+	switch head.Com {
+	case ek.CMD_UNIT_INFO.Response():
+		if info, err := ek.ParseUnitInfo(data); err == nil {
+			lines = append(lines, fmt.Sprintf("Serial: %s", info.Serial),
+				fmt.Sprintf("MAC: %s", info.MAC),
+				fmt.Sprintf("Firmware: %s", info.Firmware),
+				fmt.Sprintf("Article: %s", info.Article))
+		}
+	case ek.CMD_CALIBRATION.Response():
+		if len(data) <= 4 {
+			break
+		}
+		calib, err := ek.NewCalibration(data[4:])
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("Calibration: %s", err))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("Adjustment: %s, %d entries", calib.Adjustment.Date, len(calib.Adjustment.Data)))
+		if calib.Certificate != nil {
+			lines = append(lines, fmt.Sprintf("Certificate: %s %s, %d checks", calib.Certificate.Date, calib.Certificate.Hardware, len(calib.Certificate.Data)))
+		}
+	case ek.CMD_CHANNEL_DATA:
+		lines = append(lines, fmt.Sprintf("%d samples", len(data)/8))
+	default:
+		if p, err := ek.DecodePayload(head.Com, data); err != nil {
+			lines = append(lines, err.Error())
+		} else if p != nil {
+			lines = append(lines, fmt.Sprintf("%+v", p))
+		}
+	}
+	return lines
+}
+
+func (c *console) print(head ek.EKHeader, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if head.Com == ek.CMD_CHANNEL_DATA && !c.data {
+		return
+	}
+	rtt := ""
+	if t, ok := c.sent[head.Seq]; ok && head.Com.IsResponse() {
+		rtt = fmt.Sprintf(" rtt %v", time.Since(t))
+	}
+	fmt.Printf("<- %s ver %d seq %d param %d len %d%s\n", head.Com, head.Ver, head.Seq, head.Param, head.Len, rtt)
+	for _, l := range describe(head, data) {
+		fmt.Printf("   %s\n", l)
+	}
+	if len(data) > 0 && *dump > 0 {
+		b := data
+		if len(b) > *dump {
+			b = b[:*dump]
+		}
+		fmt.Print(hex.Dump(b))
+		if len(data) > len(b) {
+			fmt.Printf("   ... %d more bytes\n", len(data)-len(b))
+		}
+	}
+	if done, ok := c.replies[head.Seq]; ok && head.Com.IsResponse() {
+		close(done)
+		delete(c.replies, head.Seq)
+		delete(c.sent, head.Seq)
+	}
+}
+
+func (c *console) receive() {
+	for {
+		head, data, err := ek.ReadPacket(c.conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("%s\n", err)
+			}
+			log.Printf("Connection closed\n")
+			os.Exit(1)
+		}
+		c.print(head, data)
+	}
+}
+
+//Send command and wait for its reply
+func (c *console) send(com ek.Command, param int32, payload []byte) {
+	done := make(chan bool)
+	c.mu.Lock()
+	seq := c.seq
+	c.seq++
+	c.replies[seq] = done
+	c.sent[seq] = time.Now()
+	fmt.Printf("-> %s seq %d param %d len %d\n", com, seq, param, len(payload))
+	c.mu.Unlock()
+	request := ek.EKHeader{Ver: 2, Com: com, Len: int32(len(payload)), Param: param, Seq: seq}
+	binary.Write(c.conn, binary.BigEndian, &request)
+	c.conn.Write(payload)
+	select {
+	case <-done:
+	case <-time.After(*timeout):
+		fmt.Printf("   no reply to seq %d after %v\n", seq, *timeout)
+		c.mu.Lock()
+		delete(c.replies, seq)
+		delete(c.sent, seq)
+		c.mu.Unlock()
+	}
+}
+
+//Optional param and hex payload after the command
+func parseArgs(args []string) (param int32, payload []byte, err error) {
+	if len(args) > 0 {
+		p, err := strconv.ParseInt(args[0], 0, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad param %q", args[0])
+		}
+		param = int32(p)
+	}
+	if len(args) > 1 {
+		payload, err = hex.DecodeString(strings.Join(args[1:], ""))
+		if err != nil {
+			return 0, nil, fmt.Errorf("bad payload: %s", err)
+		}
+	}
+	return param, payload, nil
+}
+
+func help() {
+	fmt.Println("send <com> [param] [hex payload]")
+	names := make([]string, 0, len(shortcuts))
+	for name := range shortcuts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := shortcuts[name]
+		fmt.Printf("%-8s 0x%02x  %s\n", name, uint16(s.Com), s.Help)
+	}
+	fmt.Println("wait <duration>, data on|off, run <file>, help, quit")
+}
+
+//Run one line. Returns false on quit.
+func (c *console) exec(line string) (bool, error) {
+	f := strings.Fields(line)
+	if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+		return true, nil
+	}
+	switch f[0] {
+	case "quit", "exit":
+		return false, nil
+	case "help", "?":
+		help()
+	case "send":
+		if len(f) < 2 {
+			return true, errUsage
+		}
+		com, err := strconv.ParseUint(strings.TrimPrefix(f[1], "0x"), 16, 16)
+		if err != nil {
+			return true, errUsage
+		}
+		param, payload, err := parseArgs(f[2:])
+		if err != nil {
+			return true, err
+		}
+		c.send(ek.Command(com), param, payload)
+	case "wait":
+		if len(f) != 2 {
+			return true, errors.New("usage: wait <duration>")
+		}
+		d, err := time.ParseDuration(f[1])
+		if err != nil {
+			return true, err
+		}
+		time.Sleep(d)
+	case "data":
+		if len(f) != 2 || (f[1] != "on" && f[1] != "off") {
+			return true, errors.New("usage: data on|off")
+		}
+		c.mu.Lock()
+		c.data = f[1] == "on"
+		c.mu.Unlock()
+	case "run":
+		if len(f) != 2 {
+			return true, errors.New("usage: run <file>")
+		}
+		return c.run(f[1])
+	default:
+		s, ok := shortcuts[f[0]]
+		if !ok {
+			return true, fmt.Errorf("unknown command %q, try help", f[0])
+		}
+		param, payload, err := parseArgs(f[1:])
+		if err != nil {
+			return true, err
+		}
+		if payload == nil {
+			payload = s.Payload
+		}
+		if s.Com == ek.CMD_SYNC && payload == nil {
+			payload = syncPayload()
+		}
+		c.send(s.Com, param, payload)
+	}
+	return true, nil
+}
+
+//Run script file. Stops at the first error.
+func (c *console) run(file string) (bool, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return true, err
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		fmt.Printf("%s:%d: %s\n", file, n, scanner.Text())
+		more, err := c.exec(scanner.Text())
+		if err != nil {
+			return true, fmt.Errorf("%s:%d: %s", file, n, err)
+		}
+		if !more {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+func main() {
+	flag.Parse()
+	conn, err := net.Dial("tcp", *address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := &console{conn: conn, replies: make(map[int32]chan bool), sent: make(map[int32]time.Time)}
+	go c.receive()
+
+	if *script != "" {
+		more, err := c.run(*script)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !more || !*interactive {
+			return
+		}
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("ek> ")
+	for scanner.Scan() {
+		more, err := c.exec(scanner.Text())
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		}
+		if !more {
+			return
+		}
+		fmt.Print("ek> ")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Decoder for captured ExpertKey byte streams. Replaces parse.pl.
+// Reads hex dumps or raw binary from files or stdin. Input is either
+// frames (header + data) or bare channel data as in dumps/data.hex.
+//
+// Samples are printed in the columns of dumps/values.dump followed by
+// the adjusted value in mV:
+//
+//	ch timestamp value(27 bit) value bits channel bits value
+//
+// The bit columns are bit 0 first, split at the channel number.
+//
+// Other frames are printed as by parse.pl.
+//
+// Session recordings from ekspy (.ekr) are detected by their magic. Each
+// frame is preceded by its time and direction:
+//
+//	# 2015-06-01T12:00:00.000000+02:00 U->C
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"delphin/ek"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var calib = flag.String("calib", "", "Calibration reply XML or bare Adjustment XML (dumps/adj.xml)")
+var format = flag.String("format", "auto", "Input format: auto, hex, raw or ekr")
+var samples = flag.Bool("samples", false, "Input is channel data without frame headers. Detected with -format auto")
+var channel = flag.Int("channel", -1, "Only print channel")
+
+//Reads hex digits as bytes, skipping white space
+type hexReader struct {
+	r *bufio.Reader
+}
+
+func (h *hexReader) Read(p []byte) (int, error) {
+	var digits [2]byte
+	n := 0
+	for n < len(p) {
+		for i := 0; i < 2; {
+			c, err := h.r.ReadByte()
+			if err != nil {
+				if err == io.EOF && i == 1 {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+				continue
+			}
+			digits[i] = c
+			i++
+		}
+		if _, err := hex.Decode(p[n:n+1], digits[:]); err != nil {
+			return n, err
+		}
+		n++
+		if h.r.Buffered() == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+//True if b is hex digits and white space only
+func isHex(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			return false
+		}
+	}
+	return len(b) > 0
+}
+
+//Calibration reply or bare Adjustment element
+func loadCalibration(file string, p *ek.DeviceProfile) ([]ek.AdjustmentTable, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := ek.NewCalibration(b)
+	if err != nil {
+		adj := ek.Adjustment{}
+		if xml.Unmarshal(b, &adj) != nil {
+			return nil, err
+		}
+		c = &ek.Calibration{Adjustment: adj}
+	}
+	if err = c.Validate(p.Channels); err != nil {
+		return nil, err
+	}
+	adjt := make([]ek.AdjustmentTable, p.Channels)
+	if err = c.AdjustmentTable(p.Range, p.CoefficientScale[p.Range], adjt); err != nil {
+		return nil, err
+	}
+	return adjt, nil
+}
+
+type decoder struct {
+	profile *ek.DeviceProfile
+	adjt    []ek.AdjustmentTable
+	out     *bufio.Writer
+}
+
+//n bits of word from bit from, bit 0 first as in values.dump
+func bits(word uint32, from, n uint) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = '0' + byte(word>>(from+uint(i))&1)
+	}
+	return string(b)
+}
+
+//Print samples from channel data
+func (d *decoder) samples(data []byte) int {
+	n := 0
+	for ; len(data) >= 8; data = data[8:] {
+		timestamp := binary.LittleEndian.Uint32(data)
+		word := binary.LittleEndian.Uint32(data[4:])
+		ch := d.profile.Channel(word)
+		if *channel >= 0 && int(ch) != *channel {
+			continue
+		}
+		value := float64(d.profile.RawValue(word)) / d.profile.RawMax * ek.ENG_MAX
+		if int(ch) < len(d.adjt) {
+			value = ek.AdjustValue(value, d.adjt[ch])
+		}
+		shift := d.profile.ChannelShift
+		fmt.Fprintf(d.out, "%2d %10d %9d %s %s %12.4f\n", ch, timestamp, word&(1<<shift-1),
+			bits(word, 0, shift), bits(word, shift, 32-shift), value)
+		n++
+	}
+	return n
+}
+
+//Print frames until end of input
+func (d *decoder) frames(r io.Reader) error {
+	hbuf := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(r, hbuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var head ek.EKHeader
+		binary.Read(bytes.NewReader(hbuf), binary.BigEndian, &head)
+		if head.Len < 0 || head.Len > ek.MAX_CALIBRATION_BLOB {
+			return fmt.Errorf("bad frame length %d", head.Len)
+		}
+		data := make([]byte, head.Len)
+		if _, err := io.ReadFull(r, data); err != nil {
+			fmt.Fprintf(d.out, "Short read!\n")
+			return nil
+		}
+		if head.Com == ek.CMD_CHANNEL_DATA {
+			if d.samples(data) > 0 {
+				fmt.Fprintf(d.out, "\n")
+			}
+			continue
+		}
+		fmt.Fprintf(d.out, "UP V:%d C:%5d L:%2d U:%3d S:%7d HC:%8x DC:%8x> %s\n",
+			uint16(head.Ver), uint16(head.Com), head.Len, uint32(head.Param), head.Seq, uint32(head.HeaderCheck), uint32(head.DataCheck), hex.EncodeToString(data))
+	}
+}
+
+//Print frames from an ekspy recording
+func (d *decoder) recording(r io.Reader) error {
+	rr, err := ek.NewRecordReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		rec, err := rr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		arrow := "C->U"
+		if rec.Direction == ek.FROM_UNIT {
+			arrow = "U->C"
+		}
+		fmt.Fprintf(d.out, "# %s %s\n", rec.Time.Format("2006-01-02T15:04:05.000000Z07:00"), arrow)
+		if err := d.frames(bytes.NewReader(rec.Frame)); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *decoder) decode(in io.Reader) error {
+	br := bufio.NewReader(in)
+	peek, _ := br.Peek(512)
+	var r io.Reader = br
+	switch *format {
+	case "ekr":
+		return d.recording(br)
+	case "hex":
+		r = &hexReader{br}
+	case "raw":
+	case "auto":
+		if bytes.HasPrefix(peek, []byte(ek.RECORD_MAGIC)) {
+			return d.recording(br)
+		}
+		if isHex(peek) {
+			r = &hexReader{br}
+		}
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	rr := bufio.NewReader(r)
+	//Frames start with version 2
+	if ver, _ := rr.Peek(2); *samples || (*format == "auto" && !bytes.Equal(ver, []byte{0, 2})) {
+		b, err := ioutil.ReadAll(rr)
+		d.samples(b)
+		return err
+	}
+	return d.frames(rr)
+}
+
+func main() {
+	flag.Parse()
+	d := &decoder{profile: ek.DefaultProfile, out: bufio.NewWriter(os.Stdout)}
+	defer d.out.Flush()
+	if *calib != "" {
+		adjt, err := loadCalibration(*calib, d.profile)
+		if err != nil {
+			log.Fatalf("%s: %s", *calib, err)
+		}
+		d.adjt = adjt
+	}
+	if flag.NArg() == 0 {
+		if err := d.decode(os.Stdin); err != nil {
+			d.out.Flush()
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, file := range flag.Args() {
+		fh, err := os.Open(file)
+		if err != nil {
+			d.out.Flush()
+			log.Fatal(err)
+		}
+		err = d.decode(fh)
+		fh.Close()
+		if err != nil {
+			d.out.Flush()
+			log.Fatalf("%s: %s", file, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Export channels and a time range to CSV or XLSX from a running web
+// server, the buffers are there. Same as /export in web/export.go.
+//
+//	ekexport -channels 0:0,0:1 -from 2015-10-05T14:00:00+02:00 -to 2015-10-05T16:00:00+02:00 -o ovner.xlsx
+//	ekexport -group Ovn -from 2015-10-05 -decimal comma -tz Europe/Oslo > ovner.csv
+//
+// The format is taken from the -o extension unless -format is given.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var server = flag.String("server", "localhost:12345", "host:port of web")
+var channels = flag.String("channels", "", "unit:channel list, comma separated. unit:* for all channels of a unit")
+var group = flag.String("group", "", "Channel groups, comma separated")
+var from = flag.String("from", "", "Start, RFC 3339, date or epoch seconds")
+var to = flag.String("to", "", "End, RFC 3339, date or epoch seconds")
+var resolution = flag.String("resolution", "slow", "slow (10 second averages) or fast")
+var maxPoints = flag.Int("max_points", 0, "At most this many rows, 0 for all")
+var format = flag.String("format", "", "csv or xlsx. Default from -o, else csv")
+var decimal = flag.String("decimal", "point", "CSV decimal separator, point or comma")
+var sep = flag.String("sep", "", "CSV field separator, tab for tab. Default , or ; with -decimal comma")
+var tz = flag.String("tz", "", "Time zone of the time column, local or a zone name. Default UTC")
+var output = flag.String("o", "", "Write to file instead of stdout")
+
+func main() {
+	flag.Parse()
+	if *channels == "" && *group == "" {
+		log.Fatal("-channels or -group is required")
+	}
+	f := *format
+	if f == "" {
+		f = "csv"
+		if ext := strings.ToLower(filepath.Ext(*output)); ext == ".xlsx" {
+			f = "xlsx"
+		}
+	}
+	q := url.Values{}
+	for k, v := range map[string]string{"channels": *channels, "group": *group, "from": *from, "to": *to,
+		"resolution": *resolution, "decimal": *decimal, "sep": *sep, "tz": *tz} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if *maxPoints > 0 {
+		q.Set("max_points", fmt.Sprint(*maxPoints))
+	}
+	u := "http://" + *server + "/export/" + f + "?" + q.Encode()
+	resp, err := http.Get(u)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct{ Error string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		log.Fatalf("%s: %s", resp.Status, e.Error)
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Bit field explorer. Fits sample word decoding against reference readings.
+//
+// Input is text with one sample per line, white space separated columns.
+// The sample word is hex (0x4171df30 or 4171df30) or 32 binary digits,
+// the reference is the value read in DataService or on a calibrator in mV.
+// Sample rate and measuring range may be columns too, samples are grouped
+// by them. Lines starting with # are ignored.
+//
+// For every bit offset, width and signedness the value field is fitted
+// as reference = offset + gain * field. Candidates are ranked by RMS
+// error and the best are printed for each group with the full-scale
+// constant they imply (RawMax in the profile, field left justified to
+// 32 bit).
+
+package main
+
+import (
+	"bufio"
+	"delphin/ek"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var wordCol = flag.Int("word", 1, "Column with sample word")
+var refCol = flag.Int("ref", 2, "Column with reference value (mV)")
+var rateCol = flag.Int("ratecol", 0, "Column with sample rate (Hz). 0 to use -rate")
+var rangeCol = flag.Int("rangecol", 0, "Column with measuring range (V). 0 to use -range")
+var rate = flag.Float64("rate", 1, "Sample rate when there is no rate column")
+var mrange = flag.Float64("range", 10, "Measuring range when there is no range column")
+var lsbFirst = flag.Bool("lsbfirst", false, "Binary words are written bit 0 first (as in dumps/values.dump)")
+var channel = flag.Int("channel", -1, "Only use samples from channel")
+var top = flag.Int("top", 5, "Print this many candidates per group")
+var minWidth = flag.Uint("minwidth", 8, "Narrowest value field to try")
+var noIntercept = flag.Bool("nointercept", false, "Fit gain only, reference = gain * field")
+
+type sample struct {
+	Word      uint32
+	Reference float64
+}
+
+type group struct {
+	Rate  float64
+	Range float64
+}
+
+//One decoding candidate and how well it fits
+type fit struct {
+	Offset    uint //Lowest bit of value field
+	Width     uint
+	Signed    bool
+	Intercept float64
+	Gain      float64 //mV per count
+	RMS       float64
+	MaxError  float64
+}
+
+//Full scale constant, field left justified to 32 bit. Comparable to DeviceProfile.RawMax.
+func (f *fit) RawMax(r float64) float64 {
+	return r * 1000 / f.Gain * math.Exp2(float64(32-f.Width))
+}
+
+func (f *fit) field(word uint32) float64 {
+	v := word >> f.Offset
+	if f.Width < 32 {
+		v &= 1<<f.Width - 1
+	}
+	if f.Signed {
+		return float64(int32(v<<(32-f.Width)) >> (32 - f.Width))
+	}
+	return float64(v)
+}
+
+//Least squares fit of samples to this candidate
+func (f *fit) fit(samples []sample) bool {
+	var sx, sy, sxx, sxy float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := f.field(s.Word)
+		sx += x
+		sy += s.Reference
+		sxx += x * x
+		sxy += x * s.Reference
+	}
+	if *noIntercept {
+		if sxx == 0 {
+			return false
+		}
+		f.Gain = sxy / sxx
+	} else {
+		d := n*sxx - sx*sx
+		if d == 0 {
+			return false
+		}
+		f.Gain = (n*sxy - sx*sy) / d
+		f.Intercept = (sy - f.Gain*sx) / n
+	}
+	if f.Gain == 0 || math.IsNaN(f.Gain) || math.IsInf(f.Gain, 0) {
+		return false
+	}
+	var ss float64
+	f.MaxError = 0
+	for _, s := range samples {
+		e := math.Abs(f.Intercept + f.Gain*f.field(s.Word) - s.Reference)
+		ss += e * e
+		if e > f.MaxError {
+			f.MaxError = e
+		}
+	}
+	f.RMS = math.Sqrt(ss / n)
+	return true
+}
+
+//All candidates for samples, best first
+func search(samples []sample) []fit {
+	var fits []fit
+	for offset := uint(0); offset < 32; offset++ {
+		for width := *minWidth; offset+width <= 32; width++ {
+			for _, signed := range []bool{false, true} {
+				f := fit{Offset: offset, Width: width, Signed: signed}
+				if f.fit(samples) {
+					fits = append(fits, f)
+				}
+			}
+		}
+	}
+	sort.SliceStable(fits, func(i, j int) bool {
+		//Prefer the narrowest field among equal fits. Extra high bits are often sign bits.
+		if math.Abs(fits[i].RMS-fits[j].RMS) <= 1e-9*math.Max(fits[i].RMS, 1) {
+			return fits[i].Width < fits[j].Width
+		}
+		return fits[i].RMS < fits[j].RMS
+	})
+	return fits
+}
+
+func parseWord(s string) (uint32, error) {
+	if len(s) == 32 && strings.Trim(s, "01") == "" {
+		if *lsbFirst {
+			r := []byte(s)
+			for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+				r[i], r[j] = r[j], r[i]
+			}
+			s = string(r)
+		}
+		v, err := strconv.ParseUint(s, 2, 32)
+		return uint32(v), err
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	return uint32(v), err
+}
+
+func column(f []string, col int) (string, error) {
+	if col < 1 || col > len(f) {
+		return "", fmt.Errorf("no column %d", col)
+	}
+	return f[col-1], nil
+}
+
+func readSamples(file string) (map[group][]sample, error) {
+	fh := os.Stdin
+	if file != "-" {
+		var err error
+		if fh, err = os.Open(file); err != nil {
+			return nil, err
+		}
+		defer fh.Close()
+	}
+	groups := make(map[group][]sample)
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		var s sample
+		g := group{*rate, *mrange}
+		ws, err := column(f, *wordCol)
+		if err == nil {
+			s.Word, err = parseWord(ws)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: word: %s", file, n, err)
+		}
+		rs, err := column(f, *refCol)
+		if err == nil {
+			s.Reference, err = strconv.ParseFloat(rs, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: reference: %s", file, n, err)
+		}
+		if *rateCol > 0 {
+			rs, err := column(f, *rateCol)
+			if err == nil {
+				g.Rate, err = strconv.ParseFloat(rs, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: rate: %s", file, n, err)
+			}
+		}
+		if *rangeCol > 0 {
+			rs, err := column(f, *rangeCol)
+			if err == nil {
+				g.Range, err = strconv.ParseFloat(rs, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: range: %s", file, n, err)
+			}
+		}
+		if *channel >= 0 && int(ek.DefaultProfile.Channel(s.Word)) != *channel {
+			continue
+		}
+		groups[g] = append(groups[g], s)
+	}
+	return groups, scanner.Err()
+}
+
+//How the current profile decodes samples, for comparison
+func current(samples []sample, r float64) fit {
+	p := ek.DefaultProfile
+	f := fit{Offset: 0, Width: p.ValueBits, Signed: true, Gain: r * 1000 / p.RawMax * math.Exp2(float64(32-p.ValueBits))}
+	var ss float64
+	for _, s := range samples {
+		e := math.Abs(f.Gain*f.field(s.Word) - s.Reference)
+		ss += e * e
+		if e > f.MaxError {
+			f.MaxError = e
+		}
+	}
+	f.RMS = math.Sqrt(ss / float64(len(samples)))
+	return f
+}
+
+func main() {
+	flag.Parse()
+	file := "-"
+	if flag.NArg() > 0 {
+		file = flag.Arg(0)
+	}
+	groups, err := readSamples(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys := make([]group, 0, len(groups))
+	for g := range groups {
+		keys = append(keys, g)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate < keys[j].Rate
+		}
+		return keys[i].Range < keys[j].Range
+	})
+	for _, g := range keys {
+		samples := groups[g]
+		fmt.Printf("%g Hz, range %g V: %d samples\n", g.Rate, g.Range, len(samples))
+		if len(samples) < 3 {
+			fmt.Printf("  Too few samples\n\n")
+			continue
+		}
+		fmt.Printf("  %6s %5s %6s %12s %14s %14s %10s %10s\n", "Offset", "Width", "Signed", "Intercept", "Gain", "RawMax", "RMS", "MaxError")
+		fits := search(samples)
+		for i := 0; i < *top && i < len(fits); i++ {
+			f := fits[i]
+			fmt.Printf("  %6d %5d %6t %12.4f %14.6e %14.0f %10.4f %10.4f\n", f.Offset, f.Width, f.Signed, f.Intercept, f.Gain, f.RawMax(g.Range), f.RMS, f.MaxError)
+		}
+		c := current(samples, g.Range)
+		fmt.Printf("  Current %s decode (ValueBits %d, RawMax %.0f): RMS %.4f MaxError %.4f\n\n", ek.DefaultProfile.Name, ek.DefaultProfile.ValueBits, ek.DefaultProfile.RawMax, c.RMS, c.MaxError)
+	}
+}
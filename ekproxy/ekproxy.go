@@ -0,0 +1,242 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Protocol proxy for Delphin ExpertKey DAQs.
+// Holds one session to the unit and lets several clients share it.
+// Unit information and calibration replies are served from cache,
+// channel data is copied to every streaming client and commands that
+// may change unit state are only accepted from one client at a time.
+
+package main
+
+import (
+	"bytes"
+	"delphin/ek"
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"sync"
+)
+
+const CLIENT_QUEUE = 1000 //Frames queued per client before dropping
+
+var address = flag.String("address", "192.168.251.50:1034", "ip:port to ExpertKey Device")
+var listen = flag.String("listen", ":1034", "Listen for clients on ip:port")
+var control = flag.String("control", "", "Only clients from this ip may send other commands. Default is first client to try")
+var calibdir = flag.String("calibdir", "calib", "Directory for last known good calibration")
+
+//Replies that are the same for every client. Answered from cache.
+var cachedCommands = map[ek.Command]bool{
+	ek.CMD_INIT:         true,
+	ek.CMD_UNIT_INFO:    true,
+	ek.CMD_NET_INFO:     true,
+	ek.CMD_CALIB_INFO:   true,
+	ek.CMD_CALIBRATION:  true,
+	ek.CMD_CHANNEL_INFO: true,
+}
+
+//Forwarded for any client
+var sharedCommands = map[ek.Command]bool{
+	ek.CMD_SYNC: true,
+}
+
+type frame struct {
+	head ek.EKHeader
+	data []byte
+}
+
+type client struct {
+	conn      net.Conn
+	out       chan frame
+	streaming bool
+	dropped   int
+}
+
+//Queue frame for client. Never blocks, a slow client loses frames.
+func (c *client) send(f frame) {
+	select {
+	case c.out <- f:
+	default:
+		c.dropped++
+		if c.dropped%1000 == 1 {
+			log.Printf("Client %s is too slow. %d frames dropped\n", c.conn.RemoteAddr(), c.dropped)
+		}
+	}
+}
+
+func (c *client) writer() {
+	for f := range c.out {
+		buf := new(bytes.Buffer)
+		binary.Write(buf, binary.BigEndian, &f.head)
+		buf.Write(f.data)
+		if _, err := c.conn.Write(buf.Bytes()); err != nil {
+			c.conn.Close()
+			for _ = range c.out {
+			}
+			return
+		}
+	}
+}
+
+type pendingRequest struct {
+	c   *client
+	seq int32
+}
+
+type proxy struct {
+	up *ek.EKReceiver
+
+	mu         sync.Mutex
+	clients    map[*client]bool
+	cache      map[ek.Command]frame     //Last reply by request command
+	pending    map[int32]pendingRequest //Forwarded requests by upstream sequence number
+	controller *client                  //Client allowed to send other commands
+}
+
+//Called by the receiver for every frame from the unit
+func (p *proxy) upstreamFrame(head ek.EKHeader, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if head.Com.IsResponse() {
+		req := head.Com.Request()
+		if req == ek.CMD_INIT { //New upstream session, sequence numbers start over
+			p.pending = make(map[int32]pendingRequest)
+		}
+		if cachedCommands[req] {
+			p.cache[req] = frame{head, data}
+		}
+		if r, ok := p.pending[head.Seq]; ok {
+			delete(p.pending, head.Seq)
+			head.Seq = r.seq
+			r.c.send(frame{head, data})
+		}
+		return
+	}
+	for c := range p.clients {
+		if c.streaming {
+			c.send(frame{head, data})
+		}
+	}
+}
+
+//Route the reply to request from c back to c. Must hold p.mu. Returns the
+//upstream write, to be called without p.mu: a backed up unit must never
+//block upstreamFrame.
+func (p *proxy) forward(c *client, head ek.EKHeader, data []byte) func() {
+	seq := p.up.ReserveSeq()
+	p.pending[seq] = pendingRequest{c, head.Seq}
+	return func() {
+		if err := p.up.SendSeq(head.Com, head.Param, seq, data); err != nil {
+			log.Printf("Could not forward %s from %s: %s\n", head.Com, c.conn.RemoteAddr(), err)
+			p.mu.Lock()
+			delete(p.pending, seq)
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *proxy) allowed(c *client) bool {
+	if *control != "" {
+		host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+		return host == *control
+	}
+	if p.controller == nil {
+		p.controller = c
+		log.Printf("Client %s has control\n", c.conn.RemoteAddr())
+	}
+	return p.controller == c
+}
+
+func (p *proxy) request(c *client, head ek.EKHeader, data []byte) {
+	var write func() //Forwarded request, sent after unlocking
+	p.mu.Lock()
+	reply := ek.EKHeader{Ver: head.Ver, Com: head.Com.Response(), Seq: head.Seq}
+	switch {
+	case head.Com == ek.CMD_START:
+		c.streaming = true
+		c.send(frame{reply, nil})
+	case head.Com == ek.CMD_STOP:
+		c.streaming = false
+		c.send(frame{reply, nil})
+	case cachedCommands[head.Com]:
+		if f, ok := p.cache[head.Com]; ok {
+			f.head.Seq = head.Seq
+			c.send(f)
+		} else {
+			write = p.forward(c, head, data)
+		}
+	case sharedCommands[head.Com]:
+		write = p.forward(c, head, data)
+	case p.allowed(c):
+		log.Printf("Forwarding %s (%d bytes) from %s\n", head.Com, len(data), c.conn.RemoteAddr())
+		write = p.forward(c, head, data)
+	default:
+		log.Printf("Refused %s from %s. Another client has control\n", head.Com, c.conn.RemoteAddr())
+		c.send(frame{reply, nil})
+	}
+	p.mu.Unlock()
+	if write != nil {
+		write()
+	}
+}
+
+func (p *proxy) serve(conn net.Conn) {
+	c := &client{conn: conn, out: make(chan frame, CLIENT_QUEUE)}
+	log.Printf("Client %s connected\n", conn.RemoteAddr())
+	p.mu.Lock()
+	p.clients[c] = true
+	p.mu.Unlock()
+	go c.writer()
+
+	for {
+		head, data, err := ek.ReadPacket(conn)
+		if err != nil {
+			break
+		}
+		p.request(c, head, data)
+	}
+
+	p.mu.Lock()
+	delete(p.clients, c)
+	if p.controller == c {
+		p.controller = nil
+	}
+	for seq, r := range p.pending {
+		if r.c == c {
+			delete(p.pending, seq)
+		}
+	}
+	close(c.out)
+	p.mu.Unlock()
+	conn.Close()
+	log.Printf("Client %s disconnected. %d frames dropped\n", conn.RemoteAddr(), c.dropped)
+}
+
+func main() {
+	flag.Parse()
+	p := &proxy{
+		clients: make(map[*client]bool),
+		cache:   make(map[ek.Command]frame),
+		pending: make(map[int32]pendingRequest),
+	}
+	p.up = ek.NewEKReceiverProfile(*address, ek.ProbeProfile(*address))
+	p.up.CalibStore = ek.NewCalibrationStore(*calibdir)
+	p.up.FrameHook = p.upstreamFrame
+	go p.up.Stream(func(ek.EKChannelData) {})
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening on %s\n", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("%s\n", err)
+			continue
+		}
+		go p.serve(conn)
+	}
+}
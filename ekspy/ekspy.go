@@ -0,0 +1,216 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Protocol recorder for Delphin ExpertKey DAQs.
+// Sits between vendor software and the unit, logs every frame and
+// optionally records the session for later study.
+
+package main
+
+import (
+	"bytes"
+	"delphin/ek"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var address = flag.String("address", "192.168.251.50:1034", "ip:port to ExpertKey Device")
+var listen = flag.String("listen", ":1034", "Listen for vendor software on ip:port")
+var record = flag.String("record", "", "Record sessions to this directory")
+var pcapng = flag.Bool("pcapng", false, "Also record sessions as pcapng")
+var nodata = flag.Bool("nodata", false, "Do not log channel data frames")
+
+type session struct {
+	n      int
+	client net.Conn
+	unit   net.Conn
+
+	mu       sync.Mutex
+	start    time.Time
+	last     time.Time
+	requests map[int32]time.Time //Request time by sequence number
+	rec      *ek.RecordWriter
+	pcap     *PcapWriter
+	files    []*os.File //Recording files, closed by close
+}
+
+//Short description of frame contents
+func annotate(head ek.EKHeader, data []byte) string {
+	switch {
+	case head.Com == ek.CMD_CHANNEL_DATA:
+		return fmt.Sprintf("%d samples", len(data)/8)
+	case head.Com == ek.CMD_UNIT_INFO.Response():
+		if info, err := ek.ParseUnitInfo(data); err == nil {
+			return fmt.Sprintf("serial %s firmware %s", info.Serial, info.Firmware)
+		}
+	case head.Com == ek.CMD_CALIBRATION.Response() && len(data) > 4:
+		if calib, err := ek.NewCalibration(data[4:]); err == nil {
+			return fmt.Sprintf("adjustment %s, %d entries", calib.Adjustment.Date, len(calib.Adjustment.Data))
+		}
+	}
+	if len(data) > 0 && len(data) <= 32 {
+		return hex.EncodeToString(data)
+	}
+	return ""
+}
+
+func (s *session) frame(t time.Time, dir uint8, head ek.EKHeader, frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arrow := "C->U"
+	rtt := ""
+	if dir == ek.TO_UNIT {
+		s.requests[head.Seq] = t
+	} else {
+		arrow = "U->C"
+		if head.Com.IsResponse() {
+			if r, ok := s.requests[head.Seq]; ok {
+				rtt = fmt.Sprintf(" rtt %v", t.Sub(r))
+				delete(s.requests, head.Seq)
+			}
+		}
+	}
+	if !(*nodata && head.Com == ek.CMD_CHANNEL_DATA) {
+		fmt.Printf("%d %12.6f %+10.3fms %s %-32s seq %-6d par %-4d len %-6d%s %s\n",
+			s.n, t.Sub(s.start).Seconds(), float64(t.Sub(s.last))/float64(time.Millisecond),
+			arrow, head.Com, head.Seq, head.Param, head.Len, rtt, annotate(head, frame[24:]))
+	}
+	s.last = t
+	rec := ek.Record{Time: t, Direction: dir, Frame: frame}
+	if s.rec != nil {
+		if err := s.rec.Write(rec); err != nil {
+			log.Printf("Recording stopped: %s\n", err)
+			s.rec = nil
+		}
+	}
+	if s.pcap != nil {
+		if err := s.pcap.Write(rec); err != nil {
+			log.Printf("Pcapng recording stopped: %s\n", err)
+			s.pcap = nil
+		}
+	}
+}
+
+//Copy frames from src to dst
+func (s *session) pump(src, dst net.Conn, dir uint8) {
+	defer src.Close()
+	defer dst.Close()
+	hbuf := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(src, hbuf); err != nil {
+			return
+		}
+		var head ek.EKHeader
+		binary.Read(bytes.NewReader(hbuf), binary.BigEndian, &head)
+		if head.Len < 0 || head.Len > ek.MAX_FRAME {
+			log.Printf("Session %d: bad frame length %d. Copying without decoding\n", s.n, head.Len)
+			dst.Write(hbuf)
+			io.Copy(dst, src)
+			return
+		}
+		frame := make([]byte, 24+head.Len)
+		copy(frame, hbuf)
+		if _, err := io.ReadFull(src, frame[24:]); err != nil {
+			return
+		}
+		//Log before forwarding so a request is always seen before its reply
+		s.frame(time.Now(), dir, head, frame)
+		if _, err := dst.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) open() error {
+	if *record == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*record, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(*record, fmt.Sprintf("ekspy-%s-%d", s.start.Format("20060102-150405"), s.n))
+	fh, err := os.Create(name + ".ekr")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, fh)
+	if s.rec, err = ek.NewRecordWriter(fh); err != nil {
+		return err
+	}
+	log.Printf("Session %d: recording to %s.ekr\n", s.n, name)
+	if !*pcapng {
+		return nil
+	}
+	fh, err = os.Create(name + ".pcapng")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, fh)
+	s.pcap, err = NewPcapWriter(fh, s.client.RemoteAddr().(*net.TCPAddr), s.unit.RemoteAddr().(*net.TCPAddr))
+	return err
+}
+
+//Close recordings
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rec = nil
+	s.pcap = nil
+	for _, fh := range s.files {
+		if err := fh.Close(); err != nil {
+			log.Printf("Session %d: %s\n", s.n, err)
+		}
+	}
+	s.files = nil
+}
+
+func serve(n int, client net.Conn) {
+	log.Printf("Session %d: %s connected\n", n, client.RemoteAddr())
+	unit, err := net.Dial("tcp", *address)
+	if err != nil {
+		log.Printf("Session %d: %s\n", n, err)
+		client.Close()
+		return
+	}
+	now := time.Now()
+	s := &session{n: n, client: client, unit: unit, start: now, last: now, requests: make(map[int32]time.Time)}
+	defer s.close()
+	if err := s.open(); err != nil {
+		log.Printf("Session %d: %s\n", n, err)
+	}
+	done := make(chan bool)
+	go func() {
+		s.pump(unit, client, ek.FROM_UNIT)
+		done <- true
+	}()
+	s.pump(client, unit, ek.TO_UNIT)
+	<-done
+	log.Printf("Session %d: closed after %v\n", n, time.Since(s.start))
+}
+
+func main() {
+	flag.Parse()
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Listening on %s, relaying to %s\n", l.Addr(), *address)
+	for n := 1; ; n++ {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("%s\n", err)
+			continue
+		}
+		go serve(n, conn)
+	}
+}
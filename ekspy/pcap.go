@@ -0,0 +1,99 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Session recordings as pcapng. The replay format is in package ek.
+
+package main
+
+import (
+	"bufio"
+	"delphin/ek"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const PCAP_MSS = 1460 //Frames are split in segments of this size
+
+//Writes frames as TCP segments between client and unit so Wireshark can follow the stream.
+//Addresses, ports and sequence numbers are real, checksums are not.
+type PcapWriter struct {
+	w            *bufio.Writer
+	client, unit *net.TCPAddr
+	seq          [2]uint32 //Next TCP sequence number per direction
+}
+
+func NewPcapWriter(w io.Writer, client, unit *net.TCPAddr) (*PcapWriter, error) {
+	p := &PcapWriter{w: bufio.NewWriter(w), client: client, unit: unit}
+	//Section Header Block
+	p.block(0x0a0d0d0a, []byte{0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	//Interface Description Block. Ethernet, no snaplen
+	p.block(1, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	return p, p.w.Flush()
+}
+
+func (p *PcapWriter) block(t uint32, body []byte) {
+	pad := (4 - len(body)%4) % 4
+	l := uint32(12 + len(body) + pad)
+	binary.Write(p.w, binary.LittleEndian, t)
+	binary.Write(p.w, binary.LittleEndian, l)
+	p.w.Write(body)
+	p.w.Write(make([]byte, pad))
+	binary.Write(p.w, binary.LittleEndian, l)
+}
+
+func ip4(a *net.TCPAddr) []byte {
+	if ip := a.IP.To4(); ip != nil {
+		return ip
+	}
+	return []byte{127, 0, 0, 1}
+}
+
+func (p *PcapWriter) Write(rec ek.Record) error {
+	for data := rec.Frame; len(data) > 0; {
+		n := len(data)
+		if n > PCAP_MSS {
+			n = PCAP_MSS
+		}
+		p.segment(rec.Time, rec.Direction, data[:n])
+		data = data[n:]
+	}
+	return p.w.Flush()
+}
+
+//One TCP segment in an Enhanced Packet Block
+func (p *PcapWriter) segment(t time.Time, dir uint8, data []byte) {
+	src, dst := p.client, p.unit
+	if dir == ek.FROM_UNIT {
+		src, dst = p.unit, p.client
+	}
+	pkt := make([]byte, 14+20+20, 14+20+20+len(data))
+	pkt[12], pkt[13] = 0x08, 0x00 //IPv4
+	ip := pkt[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(data)))
+	ip[8] = 64
+	ip[9] = 6 //TCP
+	copy(ip[12:], ip4(src))
+	copy(ip[16:], ip4(dst))
+	tcp := pkt[34:54]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], p.seq[dir])
+	binary.BigEndian.PutUint32(tcp[8:], p.seq[1-dir])
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 //PSH ACK
+	binary.BigEndian.PutUint16(tcp[14:], 0xffff)
+	pkt = append(pkt, data...)
+	p.seq[dir] += uint32(len(data))
+
+	ts := uint64(t.UnixNano() / 1000)
+	body := make([]byte, 20, 20+len(pkt))
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(pkt)))
+	p.block(6, append(body, pkt...))
+}
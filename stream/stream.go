@@ -7,22 +7,47 @@
 package main
 
 import (
+	"delphin/ek"
 	"flag"
 	"fmt"
+	"log"
 )
 
 var address = flag.String("address", "192.168.251.50:1034", "ip:port to ExpertKey Device")
 var channel = flag.Int("channel", -1, "Only stream channel")
+var calibdir = flag.String("calibdir", "calib", "Directory for last known good calibration")
+var sitecal = flag.String("sitecal", ek.SITECAL_FILE, "Site calibration records")
+var openCircuit = flag.String("open_circuit", "", "Flag open circuit below this many mV, channel:mV comma separated")
+var flatline = flag.String("flatline", "", "Flag flatline below this variance in mV**2, channel:variance comma separated. Default is one ADC step squared, 0 disables")
 
 func main() {
 	flag.Parse()
 	fmt.Printf("Channel = %d\n", *channel)
-	del := NewEKReceiver(*address)
+	del = ek.NewEKReceiverProfile(*address, ek.ProbeProfile(*address))
+	del.CalibStore = ek.NewCalibrationStore(*calibdir)
+	del.SiteCalStore = ek.NewSiteCalibrationStore(*sitecal)
+	open, err := ek.ParseOpenCircuit(*openCircuit, del.Profile.Channels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	del.OpenCircuit = open
+	flat, err := ek.ParseFlatline(*flatline, del.Profile.Channels, del.Profile.LSB()*del.Profile.LSB())
+	if err != nil {
+		log.Fatal(err)
+	}
+	del.Watchdog.SetFlatline(flat)
 	del.Stream(Stream)
 }
 
-func Stream(ek EKChannelData) {
-	if (*channel > -1 && int(ek.Channel) == *channel) || *channel < 0 {
-		fmt.Printf("%3d: %032b %032b %10d %10f %10d\n", ek.Channel, ek.PacketData2, ek.RawValue, ek.Timestamp, ek.Value, ek.RawValue)
+var del *ek.EKReceiver
+
+func Stream(s ek.EKChannelData) {
+	if (*channel > -1 && int(s.Channel) == *channel) || *channel < 0 {
+		if s.Status != ek.SAMPLE_OK {
+			c := del.Gaps.Counters()[s.Channel]
+			fmt.Printf("%3d: --- %s (gaps %d, missing %d, duplicates %d, out of order %d, restarts %d)\n",
+				s.Channel, s.Status, c.Gaps, c.Missing, c.Duplicates, c.OutOfOrder, c.Restarts)
+		}
+		fmt.Printf("%3d: %032b %032b %10d %10f %10d %s\n", s.Channel, s.PacketData2, uint32(s.RawValue), s.Timestamp, s.Value, s.RawValue, s.Quality)
 	}
 }
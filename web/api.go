@@ -0,0 +1,492 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Versioned REST API.
+//
+//	GET /api/v1/units
+//	GET /api/v1/units/{u}
+//	GET /api/v1/units/{u}/channels
+//	GET /api/v1/units/{u}/channels/{c}
+//	GET /api/v1/units/{u}/channels/{c}/samples?from=&to=&since=&resolution=&max_points=&downsample=
+//	GET /api/v1/units/{u}/channels/{c}/raw?from=&to=&since=&window=&word=  (raw.go)
+//	GET /api/v1/units/{u}/channels/{c}/sitecal
+//	GET /api/v1/series?channels=&group=&from=&to=&since=&resolution=&max_points=&stddev=  (batch.go)
+//	GET /api/v1/groups
+//
+// from and to are RFC 3339 (2015-10-05T14:00:00Z, 2015-10-05T14:00:00+02:00),
+// a date (2015-10-05, UTC), or epoch seconds. Epoch values of 1e12 and
+// above are taken as milliseconds, 1e15 and above as nanoseconds (the next
+// cursor). Both are optional and inclusive.
+// since is exclusive, only newer values are returned. It takes a time like
+// from, or the next cursor of an earlier response (epoch nanoseconds).
+// Responses carry next, pass it as since to get only what is new.
+// Responses have an ETag, If-None-Match gives 304 when nothing changed.
+// resolution selects the buffer: slow (10 second averages, default) or
+// fast (filtered values every SampleTime). max_points and downsample
+// reduce the samples for charts, see downsample.go.
+//
+// Values include the site calibration record named by sitecal on the
+// channel. The sitecal resource lists the records of a channel with the
+// time each was in effect, to trace older values back to their record.
+//
+// Sample times are UTC milliseconds since the epoch. format=rfc3339 gives
+// RFC 3339 strings instead. tz=local (or a zone name, Europe/Oslo) is for
+// charts that plot epoch values as wall clock: the epoch is shifted by the
+// offset of the zone at each sample, so it follows DST. /json/slow and
+// /json/fast take the same parameters. Errors are returned
+// with a matching HTTP status and a body of {"error": "...", "status": 404}.
+
+package main
+
+import (
+	"container/ring"
+	"delphin/ek"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_PREFIX     = "/api/v1/"
+	RFC3339_MILLIS = "2006-01-02T15:04:05.000Z07:00" //format=rfc3339, sample times are milliseconds
+)
+
+type apiUnit struct {
+	Unit      int    `json:"unit"`
+	Address   string `json:"address"`
+	Connected bool   `json:"connected"`
+	Profile   string `json:"profile"`
+	Model     string `json:"model"`
+	Serial    string `json:"serial"`
+	Firmware  string `json:"firmware"`
+	Channels  int    `json:"channels"`
+}
+
+type apiChannel struct {
+	Unit      int     `json:"unit"`
+	Channel   int     `json:"channel"`
+	Name      string  `json:"name"`
+	Group     string  `json:"group"`
+	Units     string  `json:"units"` //Engineering unit of values
+	Range     float64 `json:"range"` //Measuring range, V
+	Condition string  `json:"condition"`
+	SiteCal   int     `json:"sitecal,omitempty"` //ID of the site calibration record in effect
+}
+
+//Site calibration record and when it was in effect. To is left out for the record in effect now.
+type apiSiteCal struct {
+	ID         int        `json:"id"`
+	Replaces   int        `json:"replaces,omitempty"`
+	From       time.Time  `json:"from"`
+	To         *time.Time `json:"to,omitempty"`
+	Offset     float64    `json:"offset"`
+	Gain       float64    `json:"gain"`
+	Technician string     `json:"technician"`
+	Reference  string     `json:"reference"`
+	Comment    string     `json:"comment,omitempty"`
+}
+
+type apiSamples struct {
+	Unit       apiUnit         `json:"unit"`
+	Channel    apiChannel      `json:"channel"`
+	Resolution string          `json:"resolution"`
+	From       *time.Time      `json:"from,omitempty"`
+	To         *time.Time      `json:"to,omitempty"`
+	Columns    []string        `json:"columns"`
+	Samples    [][]interface{} `json:"samples"`
+	Downsample string          `json:"downsample,omitempty"` //Method, if samples were reduced
+	Next       string          `json:"next"`                 //Cursor for since
+}
+
+type apiServer struct {
+	del         []*DelphinReceiver
+	slow_buffer [][]*ring.Ring
+	std_dev     [][]*ring.Ring //Standard deviation less common noise, as /json/slow
+	active      [][]bool       //Channels in use for the common noise, see /json/slow
+	names       ChannelNames
+}
+
+func apiError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": fmt.Sprintf(format, a...), "status": status})
+}
+
+func apiJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+//Time from RFC 3339, date or epoch. Epoch magnitudes from 1e15 are
+//nanoseconds, from 1e12 milliseconds, below that seconds.
+func parseTime(s string) (time.Time, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case i >= 1e15 || i <= -1e15:
+			return time.Unix(0, i), nil
+		case i >= 1e12 || i <= -1e12:
+			return time.Unix(0, i*int64(time.Millisecond)), nil
+		}
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.Abs(f) >= 1e12 {
+			return time.Time{}, fmt.Errorf("time %q out of range", s)
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, want RFC 3339 or epoch seconds", s)
+}
+
+//Optional time parameter. nil if not given.
+func timeParam(r *http.Request, name string) (*time.Time, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := parseTime(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return &t, nil
+}
+
+//from, to and since parameters. lower is the bound to pass to seriesRange,
+//the later of from and just after since.
+func rangeParams(r *http.Request) (from, to, since, lower *time.Time, err error) {
+	if from, err = timeParam(r, "from"); err != nil {
+		return
+	}
+	if to, err = timeParam(r, "to"); err != nil {
+		return
+	}
+	if since, err = timeParam(r, "since"); err != nil {
+		return
+	}
+	if from != nil && to != nil && to.Before(*from) {
+		err = fmt.Errorf("to is before from")
+		return
+	}
+	lower = from
+	if since != nil {
+		after := since.Add(1)
+		if lower == nil || after.After(*lower) {
+			lower = &after
+		}
+	}
+	return
+}
+
+//Cursor for the newest time t. since when there is nothing newer.
+func nextCursor(t time.Time, since *time.Time) string {
+	if t.IsZero() {
+		if since == nil {
+			return ""
+		}
+		t = *since
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+//How times are written
+type timeFormat struct {
+	loc     *time.Location //Shift epochs to wall clock here, nil for UTC
+	rfc3339 bool
+}
+
+//format and tz parameters
+func timeFormatParam(r *http.Request) (timeFormat, error) {
+	var f timeFormat
+	switch r.FormValue("format") {
+	case "", "epoch":
+	case "rfc3339":
+		f.rfc3339 = true
+	default:
+		return f, fmt.Errorf("unknown format %q, want epoch or rfc3339", r.FormValue("format"))
+	}
+	switch tz := r.FormValue("tz"); strings.ToLower(tz) {
+	case "", "utc":
+	case "local":
+		f.loc = time.Local
+	default:
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return f, fmt.Errorf("unknown tz %q", tz)
+		}
+		f.loc = loc
+	}
+	return f, nil
+}
+
+//t as epoch milliseconds or RFC 3339 string
+func (f timeFormat) stamp(t time.Time) interface{} {
+	if f.rfc3339 {
+		if f.loc == nil {
+			return t.UTC().Format(RFC3339_MILLIS)
+		}
+		return t.In(f.loc).Format(RFC3339_MILLIS)
+	}
+	ms := epochMillis(t)
+	if f.loc != nil {
+		_, offset := t.In(f.loc).Zone()
+		ms += int64(offset) * 1000
+	}
+	return ms
+}
+
+func epochMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+//Values in r between from and to (nil is open), oldest first.
+//to includes the rest of its millisecond, the resolution of sample times.
+func seriesRange(r *ring.Ring, n int, from, to *time.Time) []ek.ChannelData {
+	var out []ek.ChannelData
+	if to != nil {
+		end := to.Truncate(time.Millisecond).Add(time.Millisecond - 1)
+		to = &end
+	}
+	e := r
+	for i := 0; i < n && e != nil && e.Value != nil; i++ {
+		cd := e.Value.(ek.ChannelData)
+		if from != nil && cd.Timestamp.Before(*from) {
+			break
+		}
+		if to == nil || !cd.Timestamp.After(*to) {
+			out = append(out, cd)
+		}
+		e = e.Prev()
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (a *apiServer) unit(u int) apiUnit {
+	d := a.del[u]
+	return apiUnit{
+		Unit:      u,
+		Address:   d.addr,
+		Connected: d.connected,
+		Profile:   d.Profile.Name,
+		Model:     d.UnitInfo.Model,
+		Serial:    d.UnitInfo.Serial,
+		Firmware:  d.UnitInfo.Firmware,
+		Channels:  d.Profile.Channels,
+	}
+}
+
+func (a *apiServer) channel(u, c int) apiChannel {
+	d := a.del[u]
+	ch := apiChannel{
+		Unit:      u,
+		Channel:   c,
+		Name:      a.names.Name(u, c),
+		Group:     a.names.Group(u, c),
+		Units:     "mV",
+		Range:     d.Profile.Range,
+		Condition: d.Watchdog.Condition(uint8(c)).String(),
+	}
+	if s := d.SiteAdjustment[c]; s != nil {
+		ch.SiteCal = s.ID
+	}
+	return ch
+}
+
+//Unit and channel from path elements. Writes the error response if they are bad.
+func (a *apiServer) lookup(w http.ResponseWriter, us, cs string) (int, int, bool) {
+	u, err := strconv.Atoi(us)
+	if err != nil || u < 0 || u >= len(a.del) {
+		apiError(w, http.StatusNotFound, "no unit %s", us)
+		return 0, 0, false
+	}
+	if cs == "" {
+		return u, -1, true
+	}
+	c, err := strconv.Atoi(cs)
+	if err != nil || c < 0 || c >= a.del[u].Profile.Channels {
+		apiError(w, http.StatusNotFound, "no channel %s on unit %d", cs, u)
+		return 0, 0, false
+	}
+	return u, c, true
+}
+
+//Buffer and its size for resolution
+func (a *apiServer) source(resolution string, u, c int) (*ring.Ring, int, error) {
+	switch resolution {
+	case "", "slow":
+		return a.slow_buffer[u][c], SLOW_BUFFER_SIZE, nil
+	case "fast":
+		return a.del[u].ValueBuffer[c], BUFFER_SIZE, nil
+	}
+	return nil, 0, fmt.Errorf("unknown resolution %q, want slow or fast", resolution)
+}
+
+//Time between values for resolution
+func (a *apiServer) step(resolution string) time.Duration {
+	if resolution == "fast" && len(a.del) > 0 {
+		return a.del[0].SampleTime
+	}
+	return SLOW_INTERVAL
+}
+
+func (a *apiServer) samples(w http.ResponseWriter, r *http.Request, u, c int) {
+	from, to, since, lower, err := rangeParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	tf, err := timeFormatParam(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	max_points, method, err := downsampleParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	resolution := r.FormValue("resolution")
+	buf, n, err := a.source(resolution, u, c)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if resolution == "" {
+		resolution = "slow"
+	}
+	res := apiSamples{
+		Unit:       a.unit(u),
+		Channel:    a.channel(u, c),
+		Resolution: resolution,
+		From:       from,
+		To:         to,
+		Columns:    []string{"time", "value", "quality"},
+		Samples:    [][]interface{}{},
+	}
+	var newest time.Time
+	points := seriesRange(buf, n, lower, to)
+	if len(points) > 0 {
+		newest = points[len(points)-1].Timestamp
+	}
+	if max_points > 0 && len(points) > max_points {
+		points = downsample(points, max_points, method)
+		res.Downsample = method
+	}
+	for _, cd := range points {
+		res.Samples = append(res.Samples, []interface{}{tf.stamp(cd.Timestamp), cd.Value, cd.Quality})
+	}
+	res.Next = nextCursor(newest, since)
+	apiJSON(w, res)
+}
+
+func (a *apiServer) sitecal(w http.ResponseWriter, u, c int) {
+	d := a.del[u]
+	var records []ek.SiteCalibration
+	if d.SiteCalStore != nil {
+		var err error
+		if records, err = d.SiteCalStore.Load(); err != nil {
+			apiError(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	history := []apiSiteCal{}
+	for _, h := range ek.SiteCalibrationHistory(records, d.unitKey(), c) {
+		s := apiSiteCal{
+			ID:         h.ID,
+			Replaces:   h.Replaces,
+			From:       h.From,
+			Offset:     h.Offset,
+			Gain:       h.Gain,
+			Technician: h.Technician,
+			Reference:  h.Reference,
+			Comment:    h.Comment,
+		}
+		if !h.To.IsZero() {
+			to := h.To
+			s.To = &to
+		}
+		history = append(history, s)
+	}
+	apiJSON(w, map[string]interface{}{"unit": a.unit(u), "channel": a.channel(u, c), "sitecal": history})
+}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		apiError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/")
+	p := strings.Split(path, "/")
+	switch {
+	case path == "series":
+		a.series(w, r)
+		return
+	case path == "groups":
+		a.groups(w)
+		return
+	case p[0] != "units":
+		apiError(w, http.StatusNotFound, "no such resource %s", r.URL.Path)
+		return
+	}
+	switch len(p) {
+	case 1:
+		units := make([]apiUnit, len(a.del))
+		for u := range a.del {
+			units[u] = a.unit(u)
+		}
+		apiJSON(w, map[string]interface{}{"units": units})
+		return
+	case 2:
+		if u, _, ok := a.lookup(w, p[1], ""); ok {
+			apiJSON(w, a.unit(u))
+		}
+		return
+	case 3:
+		if p[2] != "channels" {
+			break
+		}
+		if u, _, ok := a.lookup(w, p[1], ""); ok {
+			channels := make([]apiChannel, a.del[u].Profile.Channels)
+			for c := range channels {
+				channels[c] = a.channel(u, c)
+			}
+			apiJSON(w, map[string]interface{}{"unit": a.unit(u), "channels": channels})
+		}
+		return
+	case 4, 5:
+		if p[2] != "channels" || (len(p) == 5 && p[4] != "samples" && p[4] != "raw" && p[4] != "sitecal") {
+			break
+		}
+		u, c, ok := a.lookup(w, p[1], p[3])
+		if !ok {
+			return
+		}
+		if len(p) == 4 {
+			apiJSON(w, map[string]interface{}{"unit": a.unit(u), "channel": a.channel(u, c)})
+			return
+		}
+		if p[4] == "raw" {
+			a.raw(w, r, u, c)
+			return
+		}
+		if p[4] == "sitecal" {
+			a.sitecal(w, u, c)
+			return
+		}
+		a.samples(w, r, u, c)
+		return
+	}
+	apiError(w, http.StatusNotFound, "no such resource %s", r.URL.Path)
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/ring"
+	"delphin/ek"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func osloFormat(t *testing.T, rfc3339 bool) timeFormat {
+	loc, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip(err)
+	}
+	return timeFormat{loc: loc, rfc3339: rfc3339}
+}
+
+//Clocks go from 02:00 to 03:00 on the last Sunday of March
+func TestStampSpringForward(t *testing.T) {
+	epoch, rfc := osloFormat(t, false), osloFormat(t, true)
+	for _, c := range []struct {
+		utc   string
+		wall  string
+		shift int64 //Hours added to epoch
+	}{
+		{"2015-03-29T00:59:59.999Z", "2015-03-29T01:59:59.999+01:00", 1},
+		{"2015-03-29T01:00:00.000Z", "2015-03-29T03:00:00.000+02:00", 2},
+		{"2015-03-29T01:30:00.000Z", "2015-03-29T03:30:00.000+02:00", 2},
+	} {
+		u, err := time.Parse(time.RFC3339Nano, c.utc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rfc.stamp(u); got != c.wall {
+			t.Errorf("rfc3339 %s = %v, want %s", c.utc, got, c.wall)
+		}
+		if got, want := epoch.stamp(u), epochMillis(u)+c.shift*3600000; got != want {
+			t.Errorf("epoch %s = %v, want %d", c.utc, got, want)
+		}
+	}
+}
+
+//Clocks go from 03:00 back to 02:00 on the last Sunday of October, the
+//hour 02:00-03:00 is seen twice
+func TestStampFallBack(t *testing.T) {
+	epoch, rfc := osloFormat(t, false), osloFormat(t, true)
+	for _, c := range []struct {
+		utc   string
+		wall  string
+		shift int64
+	}{
+		{"2015-10-25T00:00:00.000Z", "2015-10-25T02:00:00.000+02:00", 2},
+		{"2015-10-25T00:59:59.999Z", "2015-10-25T02:59:59.999+02:00", 2},
+		{"2015-10-25T01:00:00.000Z", "2015-10-25T02:00:00.000+01:00", 1},
+		{"2015-10-25T01:59:59.999Z", "2015-10-25T02:59:59.999+01:00", 1},
+		{"2015-10-25T02:00:00.000Z", "2015-10-25T03:00:00.000+01:00", 1},
+	} {
+		u, err := time.Parse(time.RFC3339Nano, c.utc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rfc.stamp(u); got != c.wall {
+			t.Errorf("rfc3339 %s = %v, want %s", c.utc, got, c.wall)
+		}
+		if got, want := epoch.stamp(u), epochMillis(u)+c.shift*3600000; got != want {
+			t.Errorf("epoch %s = %v, want %d", c.utc, got, want)
+		}
+	}
+	//Both 02:30 are distinct in RFC 3339 and parse back to their own instant
+	first, _ := time.Parse(time.RFC3339Nano, "2015-10-25T00:30:00Z")
+	second := first.Add(time.Hour)
+	a, b := rfc.stamp(first).(string), rfc.stamp(second).(string)
+	if a == b {
+		t.Fatalf("repeated hour stamped the same: %s", a)
+	}
+	for _, c := range []struct {
+		s string
+		t time.Time
+	}{{a, first}, {b, second}} {
+		if p, err := parseTime(c.s); err != nil || !p.Equal(c.t) {
+			t.Errorf("parseTime(%s) = %v, %v, want %v", c.s, p, err, c.t)
+		}
+	}
+	//Shifted epochs of the repeated hour overlap, the wall clock is what charts want
+	if epoch.stamp(first) != epoch.stamp(second) {
+		t.Errorf("epoch of 02:30+02:00 and 02:30+01:00 differ: %v %v", epoch.stamp(first), epoch.stamp(second))
+	}
+}
+
+func TestParseTimeEpoch(t *testing.T) {
+	want := time.Date(2015, 10, 5, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{"1444046400", "1444046400000", "1444046400000000000", "2015-10-05T14:00:00+02:00"} {
+		if got, err := parseTime(s); err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%s) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if got, _ := parseTime("1000000000000000"); !got.Equal(time.Unix(0, 1e15)) {
+		t.Errorf("parseTime(1e15) = %v, want nanoseconds", got)
+	}
+}
+
+var testStart = time.Date(2015, 10, 5, 14, 0, 0, 0, time.UTC)
+
+//One unit with a slow value every SLOW_INTERVAL from testStart on channels 0 and 1,
+//standard deviation a tenth of the value
+func testServer(values ...float64) *apiServer {
+	p := ek.EK200C
+	d := &DelphinReceiver{addr: "test:1034", Profile: p, Watchdog: ek.NewWatchdog(p.Channels, 0), SiteAdjustment: make([]*ek.SiteCalibration, p.Channels)}
+	buf := make([]*ring.Ring, p.Channels)
+	std := make([]*ring.Ring, p.Channels)
+	for c := range buf {
+		buf[c] = ring.New(SLOW_BUFFER_SIZE)
+		std[c] = ring.New(SLOW_BUFFER_SIZE)
+	}
+	for i, v := range values {
+		for c := 0; c < 2; c++ {
+			ts := testStart.Add(time.Duration(i) * SLOW_INTERVAL)
+			buf[c] = buf[c].Next()
+			buf[c].Value = ek.ChannelData{Timestamp: ts, Value: v + float64(c)}
+			std[c] = std[c].Next()
+			std[c].Value = ek.ChannelData{Timestamp: ts, Value: (v + float64(c)) / 10}
+		}
+	}
+	return &apiServer{del: []*DelphinReceiver{d}, slow_buffer: [][]*ring.Ring{buf}, std_dev: [][]*ring.Ring{std}, active: [][]bool{make([]bool, p.Channels)}, names: ChannelNames{}}
+}
+
+func testGet(t *testing.T, h http.HandlerFunc, url string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+//since is exclusive and next gives only what is new, from is inclusive
+func TestSinceCursor(t *testing.T) {
+	a := testServer(1, 2, 3, 4, 5)
+	at := func(i int) time.Time { return testStart.Add(time.Duration(i) * SLOW_INTERVAL) }
+	ms := func(i int) string { return strconv.FormatInt(epochMillis(at(i)), 10) }
+	ns := func(i int) string { return strconv.FormatInt(at(i).UnixNano(), 10) }
+	for _, c := range []struct {
+		name  string
+		query string
+		want  []float64
+		next  string
+	}{
+		{"all", "", []float64{1, 2, 3, 4, 5}, ns(4)},
+		{"from", "from=" + ms(2), []float64{3, 4, 5}, ns(4)},
+		{"since", "since=" + ms(2), []float64{4, 5}, ns(4)},
+		{"since cursor", "since=" + ns(2), []float64{4, 5}, ns(4)},
+		{"since newest", "since=" + ns(4), nil, ns(4)},
+		{"since before from", "since=" + ms(0) + "&from=" + ms(3), []float64{4, 5}, ns(4)},
+		{"from before since", "from=" + ms(0) + "&since=" + ms(3), []float64{5}, ns(4)},
+		{"since rfc3339", "since=" + at(3).Format(time.RFC3339), []float64{5}, ns(4)},
+	} {
+		w := testGet(t, a.ServeHTTP, API_PREFIX+"units/0/channels/0/samples?"+c.query)
+		var res struct {
+			Samples [][]interface{}
+			Next    string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s: %s", c.name, err, w.Body)
+		}
+		var got []float64
+		for _, s := range res.Samples {
+			got = append(got, s[1].(float64))
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		} else {
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+					break
+				}
+			}
+		}
+		if res.Next != c.next {
+			t.Errorf("%s: next %s, want %s", c.name, res.Next, c.next)
+		}
+
+		//Same for the batch query, values of channel 0
+		w = testGet(t, a.ServeHTTP, API_PREFIX+"series?channels=0:0&"+c.query)
+		var batch struct {
+			Series []struct{ Values []*float64 }
+			Next   string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+			t.Fatalf("%s: series: %s: %s", c.name, err, w.Body)
+		}
+		if len(batch.Series) != 1 || len(batch.Series[0].Values) != len(c.want) || batch.Next != c.next {
+			t.Errorf("series %s: %s", c.name, w.Body)
+		}
+	}
+}
+
+//stddev=1 gives the standard deviations on the same time axis, gaps the
+//values with samples missing before them, and marks the channels active
+func TestSeriesStdDev(t *testing.T) {
+	a := testServer(10, 20, 30)
+	cd := a.slow_buffer[0][0].Value.(ek.ChannelData)
+	cd.Gap = true
+	a.slow_buffer[0][0].Value = cd
+	w := testGet(t, a.ServeHTTP, API_PREFIX+"series?channels=0:0,0:1&stddev=1")
+	var batch struct {
+		Series []struct {
+			Values []*float64
+			StdDev []*float64
+			Gaps   []int
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	if len(batch.Series) != 2 {
+		t.Fatalf("got %s", w.Body)
+	}
+	for c, s := range batch.Series {
+		if len(s.StdDev) != len(s.Values) {
+			t.Fatalf("channel %d: %d stddev for %d values", c, len(s.StdDev), len(s.Values))
+		}
+		for j := range s.Values {
+			if *s.StdDev[j] != *s.Values[j]/10 {
+				t.Errorf("channel %d: stddev %v for %v", c, *s.StdDev[j], *s.Values[j])
+			}
+		}
+		if !a.active[0][c] {
+			t.Errorf("channel %d not active", c)
+		}
+	}
+	if g := batch.Series[0].Gaps; len(g) != 1 || g[0] != 2 {
+		t.Errorf("gaps %v, want [2]", g)
+	}
+	if g := batch.Series[1].Gaps; len(g) != 0 {
+		t.Errorf("gaps %v on channel 1", g)
+	}
+}
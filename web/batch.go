@@ -0,0 +1,275 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Batch query. Many channels in one request, aligned on one time axis.
+//
+//	GET /api/v1/series?channels=0:3,1:*&group=Ovn&from=&to=&resolution=&max_points=&stddev=
+//
+// channels takes unit:channel selectors as /push, group takes group names
+// (first word of the channel name, see channels.go), comma separated.
+// At least one of them is required. from, to and resolution are as for
+// samples in api.go, and so are since and next.
+// max_points makes the step wider when there would be more times than
+// that. The values in a slot are averaged with downsample=avg, otherwise
+// the one farthest from the average is kept, so spikes survive.
+//
+// Times are rounded to the step of the resolution (10s for slow, the
+// receiver SampleTime for fast). Every series has one value per time,
+// null where the channel has none. gaps lists the times (index into time)
+// of values with samples missing before them.
+//
+// stddev=1 adds the standard deviation of every value less the common
+// noise, as /json/slow and /push. Slow resolution only. Charts load their
+// history this way, so the channels count as in use for the common noise
+// like channels asked for on /json/slow.
+
+package main
+
+import (
+	"delphin/ek"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type apiSeries struct {
+	apiChannel
+	Values  []interface{} `json:"values"`
+	Quality []interface{} `json:"quality"`
+	Gaps    []int         `json:"gaps,omitempty"`
+	StdDev  []interface{} `json:"stddev,omitempty"`
+}
+
+type apiBatch struct {
+	Resolution string        `json:"resolution"`
+	Step       int64         `json:"step"` //Milliseconds
+	From       *time.Time    `json:"from,omitempty"`
+	To         *time.Time    `json:"to,omitempty"`
+	Time       []interface{} `json:"time"`
+	Series     []apiSeries   `json:"series"`
+	Next       string        `json:"next"` //Cursor for since
+}
+
+//Channels selected by the channels and group parameters, in unit and channel order
+func (a *apiServer) selectChannels(channels, groups string) ([]Subscription, error) {
+	subs, err := parseSubscriptions(channels, a.del)
+	if err != nil {
+		return nil, err
+	}
+	want := make(map[string]bool)
+	for _, g := range strings.Split(groups, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			want[strings.ToLower(g)] = true
+		}
+	}
+	seen := make(map[Subscription]bool)
+	var out []Subscription
+	for u, d := range a.del {
+		for c := 0; c < d.Profile.Channels; c++ {
+			selected := want[strings.ToLower(a.names.Group(u, c))]
+			for _, s := range subs {
+				selected = selected || (s.Unit == u && (s.Channel < 0 || s.Channel == c))
+			}
+			if selected && !seen[Subscription{u, c}] {
+				seen[Subscription{u, c}] = true
+				out = append(out, Subscription{u, c})
+			}
+		}
+	}
+	return out, nil
+}
+
+//Parameters of series and export
+type batchQuery struct {
+	sel                    []Subscription
+	from, to, since, lower *time.Time
+	tf                     timeFormat
+	max_points             int
+	method                 string
+	resolution             string
+	stddev                 bool
+}
+
+//Channels on one time axis
+type alignedSeries struct {
+	Step   time.Duration
+	Times  []int64             //Epoch milliseconds, oldest first
+	Values [][]*ek.ChannelData //Per channel and time, nil where the channel has none
+	StdDev [][]*ek.ChannelData //As Values, with stddev=1
+	Newest time.Time           //Newest sample, before rounding
+}
+
+//Parse the parameters of a batch query. Writes the error response if they are bad.
+func (a *apiServer) batchParams(w http.ResponseWriter, r *http.Request) (q batchQuery, ok bool) {
+	if r.FormValue("channels") == "" && r.FormValue("group") == "" {
+		apiError(w, http.StatusBadRequest, "channels or group is required")
+		return
+	}
+	var err error
+	if q.sel, err = a.selectChannels(r.FormValue("channels"), r.FormValue("group")); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if len(q.sel) == 0 {
+		apiError(w, http.StatusNotFound, "no channels in group %s", r.FormValue("group"))
+		return
+	}
+	if q.from, q.to, q.since, q.lower, err = rangeParams(r); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if q.tf, err = timeFormatParam(r); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if q.max_points, q.method, err = downsampleParams(r); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	q.resolution = r.FormValue("resolution")
+	if _, _, err = a.source(q.resolution, 0, 0); err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if q.resolution == "" {
+		q.resolution = "slow"
+	}
+	if q.stddev = r.FormValue("stddev") == "1"; q.stddev && q.resolution != "slow" {
+		apiError(w, http.StatusBadRequest, "stddev needs resolution slow")
+		return
+	}
+	return q, true
+}
+
+//Values of the query on one time axis, the step of the resolution or a
+//wider one when there would be more than max_points times
+func (a *apiServer) align(q batchQuery) alignedSeries {
+	res := alignedSeries{Step: a.step(q.resolution), Values: make([][]*ek.ChannelData, len(q.sel))}
+	ranges := make([][]ek.ChannelData, len(q.sel))
+	var oldest time.Time
+	for i, s := range q.sel {
+		buf, n, _ := a.source(q.resolution, s.Unit, s.Channel)
+		ranges[i] = seriesRange(buf, n, q.lower, q.to)
+		if l := len(ranges[i]); l > 0 {
+			if oldest.IsZero() || ranges[i][0].Timestamp.Before(oldest) {
+				oldest = ranges[i][0].Timestamp
+			}
+			if ranges[i][l-1].Timestamp.After(res.Newest) {
+				res.Newest = ranges[i][l-1].Timestamp
+			}
+		}
+	}
+	step := res.Step
+	if span := res.Newest.Sub(oldest); q.max_points > 0 && span/step >= time.Duration(q.max_points) {
+		res.Step *= span/step/time.Duration(q.max_points) + 1
+	}
+
+	//Values per channel by slot, then the union of slots as time axis
+	slot := func(points []ek.ChannelData) map[int64][]ek.ChannelData {
+		slots := make(map[int64][]ek.ChannelData)
+		for _, cd := range points {
+			t := epochMillis(cd.Timestamp.Round(res.Step))
+			slots[t] = append(slots[t], cd)
+		}
+		return slots
+	}
+	fill := func(slots map[int64][]ek.ChannelData) []*ek.ChannelData {
+		values := make([]*ek.ChannelData, len(res.Times))
+		for j, t := range res.Times {
+			if v, ok := slots[t]; ok {
+				cd := slotValue(v, q.method)
+				values[j] = &cd
+			}
+		}
+		return values
+	}
+	slots := make([]map[int64][]ek.ChannelData, len(q.sel))
+	all := make(map[int64]bool)
+	for i := range q.sel {
+		slots[i] = slot(ranges[i])
+		for t := range slots[i] {
+			all[t] = true
+		}
+	}
+	res.Times = make([]int64, 0, len(all))
+	for t := range all {
+		res.Times = append(res.Times, t)
+	}
+	sort.Slice(res.Times, func(i, j int) bool { return res.Times[i] < res.Times[j] })
+	for i := range q.sel {
+		res.Values[i] = fill(slots[i])
+	}
+	if q.stddev {
+		res.StdDev = make([][]*ek.ChannelData, len(q.sel))
+		for i, s := range q.sel {
+			res.StdDev[i] = fill(slot(seriesRange(a.std_dev[s.Unit][s.Channel], SLOW_BUFFER_SIZE, q.lower, q.to)))
+		}
+	}
+	return res
+}
+
+func (a *apiServer) series(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.batchParams(w, r)
+	if !ok {
+		return
+	}
+	al := a.align(q)
+	res := apiBatch{
+		Resolution: q.resolution,
+		Step:       int64(al.Step / time.Millisecond),
+		From:       q.from,
+		To:         q.to,
+		Time:       make([]interface{}, len(al.Times)),
+		Series:     make([]apiSeries, len(q.sel)),
+		Next:       nextCursor(al.Newest, q.since),
+	}
+	for j, t := range al.Times {
+		res.Time[j] = q.tf.stamp(time.Unix(0, t*int64(time.Millisecond)))
+	}
+	for i, s := range q.sel {
+		series := apiSeries{
+			apiChannel: a.channel(s.Unit, s.Channel),
+			Values:     make([]interface{}, len(al.Times)),
+			Quality:    make([]interface{}, len(al.Times)),
+		}
+		for j, cd := range al.Values[i] {
+			if cd != nil {
+				series.Values[j] = cd.Value
+				series.Quality[j] = cd.Quality
+				if cd.Gap {
+					series.Gaps = append(series.Gaps, j)
+				}
+			}
+		}
+		if q.stddev {
+			series.StdDev = make([]interface{}, len(al.Times))
+			for j, cd := range al.StdDev[i] {
+				if cd != nil {
+					series.StdDev[j] = cd.Value
+				}
+			}
+			if a.active != nil && !a.active[s.Unit][s.Channel] {
+				log.Printf("Set %d/%d Active", s.Unit, s.Channel)
+				a.active[s.Unit][s.Channel] = true
+			}
+		}
+		res.Series[i] = series
+	}
+	apiJSON(w, res)
+}
+
+//Groups and their channels
+func (a *apiServer) groups(w http.ResponseWriter) {
+	groups := make(map[string][]apiChannel)
+	for u, d := range a.del {
+		for c := 0; c < d.Profile.Channels; c++ {
+			if g := a.names.Group(u, c); g != "" {
+				groups[g] = append(groups[g], a.channel(u, c))
+			}
+		}
+	}
+	apiJSON(w, map[string]interface{}{"groups": groups})
+}
@@ -0,0 +1,52 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Channel names. Same layout as def in static/flogg_ovner.js, keyed by
+// "unit-channel": {"0-0": "Ovn 19", "1-9": "Ovn 09", "0-10": null}
+// The group of a channel is the first word of its name, "Ovn" above.
+// data/channels.json has the names from def.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type ChannelNames map[string]*string
+
+//Names from file. A missing file gives no names.
+func LoadChannelNames(file string) (ChannelNames, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ChannelNames{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := ChannelNames{}
+	if err = json.Unmarshal(b, &names); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return names, nil
+}
+
+//Name of channel, empty if it has none
+func (n ChannelNames) Name(unit, ch int) string {
+	if name := n[fmt.Sprintf("%d-%d", unit, ch)]; name != nil {
+		return strings.TrimSpace(*name)
+	}
+	return ""
+}
+
+//Group of channel, empty if it has no name
+func (n ChannelNames) Group(unit, ch int) string {
+	if f := strings.Fields(n.Name(unit, ch)); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
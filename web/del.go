@@ -13,7 +13,7 @@
 
 //&DelphinHeader{2,0x50,0,0,0,0,0} //No idea what this returns. Maybe chan info.
 
-//&DelphinHeader{2,0x20,0x0c,0,0,0,0} //Not sure. Some kind of sync? Looks like there is a timer / counter
+//&DelphinHeader{2,0x20,0x0c,0,0,0,0} //Sync. Reply has the unit clock (us since power on, BE) in the first 4 bytes. Rest is echoed
 // Data Examples:                         Time
 // -> 00 00 00 00 80 ad 81 1e 53 46 80 0e (22ms)
 // <- 5e 61 45 64 80 ad 81 1e 53 46 80 0e (25ms)
@@ -40,31 +40,43 @@ package main
 import (
 	"bytes"
 	"container/ring"
+	"delphin/ek"
 	"encoding/binary"
+	"fmt"
 	"log"
-	"math"
 	"net"
+	"strings"
 	"time"
-	"fmt"
 )
 
 const (
-	RAW_MAX = 2084935581 //2**32/1.03/2 (Signed)
-	ENG_MAX = 10000
-	ENG_MIN = -10000
-
 	BUFFER_SIZE     = 3000 // Buffer for filtered values 300 sec @ Reduction factor = 10
 	RAW_BUFFER_SIZE = 2500 //Keep raw values around for 25 seconds @ 100Hz
 )
 
 type DelphinReceiver struct {
-	ValueBufferRaw  []*ring.Ring      //Holds raw buffer
-	ValueBuffer     []*ring.Ring      //Holds filtered buffer
-	AdjustmentTable []AdjustmentTable //Holds channel adjustment data
+	ValueBufferRaw  []*ring.Ring             //Holds raw buffer
+	ValueBuffer     []*ring.Ring             //Holds filtered buffer
+	AdjustmentTable []ek.AdjustmentTable     //Holds channel adjustment data
+	Calibration     *ek.Calibration          //Last known good calibration
+	CalibStore      *ek.CalibrationStore     //Persist calibration per unit. nil disables
+	SiteAdjustment  []*ek.SiteCalibration    //Field calibration per channel. nil where there is none
+	SiteCalStore    *ek.SiteCalibrationStore //Field calibration records. nil disables
+	OpenCircuit     []float64                //Open circuit threshold in mV per channel, see ParseOpenCircuit. 0 or nil disables
+	Profile         *ek.DeviceProfile        //Model specific layout
+	UnitInfo        DelphinUnitInfo          //Reply to unit info request
 
 	FIRTaps    int           //For filter
 	SampleTime time.Duration //Sample the filtered buffer this often
 
+	Unknown  ek.UnknownCommands //Commands not in the registry
+	Clock    ek.DeviceClock     //Unit clock from sync replies
+	Gaps     *ek.SampleTracker  //Gap and duplicate detection per channel
+	Watchdog *ek.Watchdog       //Stale and flatline detection per channel
+	Stats    ek.ReceiverStats   //Connection and traffic counters
+
+	SampleHook func(ch uint8, cd ek.ChannelData, filtered bool) //Called with every raw and filtered value. Optional
+
 	addr        string                  //IP+Port
 	calc_chan   chan DelphinChannelData //Value calculations
 	buffer_chan chan DelphinChannelData //Value buffer
@@ -73,13 +85,14 @@ type DelphinReceiver struct {
 	ts0 uint32
 
 	connected  bool
+	siteLoaded time.Time //Last loadSiteCalibration
 	sequencenr int32
 	conn       net.Conn
 }
 
 type DelphinHeader struct {
 	Ver int16
-	Com int16
+	Com ek.Command
 
 	Len   int32
 	Param int32
@@ -99,45 +112,72 @@ type DelphinChannelData struct {
 	PacketTime   time.Time
 	Timestamp    uint32
 	Channel      uint8
-	RawValue     int32 //Raw
+	RawValue     int32  //Raw
+	Word         uint32 //As received, channel and value bits
 	Value        float64
 	Abstimestamp time.Time
+	Status       ek.SampleStatus //Gap or restart before this sample
+	Quality      ek.Quality
 	Last         bool
 }
 
-//Useful information
-type ChannelData struct {
-	Timestamp time.Time
-	Value     float64
+//Unit info reply (0x07)
+type DelphinUnitInfo struct {
+	Serial   string
+	MAC      net.HardwareAddr
+	Model    string //First word of firmware string
+	Firmware string
+	Article  string //Looks like an article or order number (M-21003609)
+}
+
+//Value in ValueBufferRaw
+type RawChannelData struct {
+	ek.ChannelData
+	Word uint32 //As received from the unit
 }
 
 // Process values coming from ADC
 func valueBuffer(d *DelphinReceiver) {
-	last_sample := make([]time.Time, 31)
+	last_sample := make([]time.Time, d.Profile.Channels)
+	gap := make([]bool, d.Profile.Channels)           //Gap since last filtered value
+	quality := make([]ek.Quality, d.Profile.Channels) //Flags since last filtered value
 
-	for i := 0; i < 31; i++ {
+	for i := 0; i < d.Profile.Channels; i++ {
 		d.ValueBufferRaw[i] = ring.New(RAW_BUFFER_SIZE)
 		d.ValueBuffer[i] = ring.New(BUFFER_SIZE)
 	}
 	for {
 		v := <-d.buffer_chan
+		gap[v.Channel] = gap[v.Channel] || v.Status != ek.SAMPLE_OK
+		quality[v.Channel] |= v.Quality
 
 		//Move head forwards
 		d.ValueBufferRaw[v.Channel] = d.ValueBufferRaw[v.Channel].Next()
-		d.ValueBufferRaw[v.Channel].Value = ChannelData{v.Abstimestamp, v.Value} //Set value
+		d.ValueBufferRaw[v.Channel].Value = RawChannelData{ek.ChannelData{Timestamp: v.Abstimestamp, Value: v.Value, Gap: v.Status != ek.SAMPLE_OK, Quality: v.Quality}, v.Word} //Set value
+		if d.SampleHook != nil {
+			d.SampleHook(v.Channel, d.ValueBufferRaw[v.Channel].Value.(RawChannelData).ChannelData, false)
+		}
 
 		// FIR Calculation
 		p0 := d.ValueBufferRaw[v.Channel]
 		i := 0
 		out := float64(0)
 		for ; i < d.FIRTaps && p0.Value != nil; i++ {
-			out += p0.Value.(ChannelData).Value
+			out += p0.Value.(RawChannelData).Value
 			p0 = p0.Prev()
 		}
 		out = out / float64(i)
 		if v.Abstimestamp.Sub(last_sample[v.Channel]) >= d.SampleTime {
 			d.ValueBuffer[v.Channel] = d.ValueBuffer[v.Channel].Next()
-			d.ValueBuffer[v.Channel].Value = ChannelData{v.Abstimestamp, out}
+			if gap[v.Channel] {
+				quality[v.Channel] |= ek.QUALITY_INTERPOLATED
+			}
+			d.ValueBuffer[v.Channel].Value = ek.ChannelData{Timestamp: v.Abstimestamp, Value: out, Gap: gap[v.Channel], Quality: quality[v.Channel]}
+			if d.SampleHook != nil {
+				d.SampleHook(v.Channel, d.ValueBuffer[v.Channel].Value.(ek.ChannelData), true)
+			}
+			gap[v.Channel] = false
+			quality[v.Channel] = ek.QUALITY_GOOD
 			last_sample[v.Channel] = v.Abstimestamp
 		}
 	}
@@ -152,7 +192,9 @@ func valueCalc(d *DelphinReceiver) {
 		i := <-d.calc_chan
 
 		//Calculate and Adjust Engineering value
-		i.Value = adjustValue(float64(float64(i.RawValue)/RAW_MAX)*ENG_MAX, d.AdjustmentTable[i.Channel])
+		i.Value = d.engValue(i.Channel, float64(i.RawValue))
+		i.Quality = d.valueQuality(i.Channel, float64(i.RawValue))
+		i.Quality |= d.Watchdog.Sample(i.Channel, i.PacketTime, i.Value)
 
 		//Convert timestamp to Absolute timestamp
 		//Note: This timestamp can be sligltly in the future. (100ms)
@@ -161,22 +203,20 @@ func valueCalc(d *DelphinReceiver) {
 		//Sync every 100k mesurments, this causes some jitter due to network latency (+-1ms)
 		//Somekind of incremental adjustment would be better
 
-		if sync {
+		if sync || i.Status == ek.SAMPLE_RESTART {
 			sync = false
 			d.at0 = i.PacketTime
 			td = 0
 			d.ts0 = i.Timestamp
 		}
 
-		if d.ts0 > i.Timestamp {
-			td += (1 << 32) - uint64(d.ts0)
-			td += uint64(i.Timestamp)
-			d.ts0 = i.Timestamp
-		} else {
-			td += uint64(i.Timestamp - d.ts0)
-			d.ts0 = i.Timestamp
-		}
+		//Modulo 2**32. Out of order samples are dropped before this
+		td += uint64(i.Timestamp - d.ts0)
+		d.ts0 = i.Timestamp
 		i.Abstimestamp = d.at0.Add(time.Duration(td * 1000))
+		if t, ok := d.Clock.Time(i.Timestamp); ok {
+			i.Abstimestamp = t //Unit clock from sync replies. No network jitter or drift
+		}
 		d.buffer_chan <- i
 
 		if m > 100000 {
@@ -189,20 +229,101 @@ func valueCalc(d *DelphinReceiver) {
 	}
 }
 
-// ADC Correction
-func adjustValue(v float64, adj AdjustmentTable) float64 {
-	if adj.Orders == 4 {
-		return adj.Order[0] + adj.Order[1]*v + adj.Order[2]*math.Pow10(-9)*math.Pow(v, 2) + adj.Order[3]*math.Pow10(-13)*math.Pow(v, 3)
-	} else if adj.Orders == 3 {
-		return adj.Order[0] + adj.Order[1]*v + adj.Order[2]*math.Pow10(-9)*math.Pow(v, 2)
-	} else if adj.Orders == 2 {
-		return adj.Order[0] + adj.Order[1]*v
-	} else if adj.Orders == 1 {
-		return adj.Order[0] + v
+//Zero terminated string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func parseUnitInfo(b []byte) (DelphinUnitInfo, error) {
+	var info DelphinUnitInfo
+	p, err := ek.DecodePayload(ek.CMD_UNIT_INFO.Response(), b)
+	if err != nil {
+		return info, err
+	}
+	r := p.(ek.UnitInfoResponse)
+	info.Serial = cString(r.Serial[:])
+	info.MAC = net.HardwareAddr(append([]byte(nil), r.MAC[:]...))
+	info.Firmware = cString(r.Firmware[:])
+	if f := strings.Fields(info.Firmware); len(f) > 0 {
+		info.Model = f[0]
+	}
+	info.Article = cString(r.Article[:])
+	return info, nil
+}
+
+//Factory adjustment followed by site calibration
+func (d *DelphinReceiver) engValue(ch uint8, raw float64) float64 {
+	v := ek.AdjustValue(float64(raw/d.Profile.RawMax)*ek.ENG_MAX, d.AdjustmentTable[ch])
+	if s := d.SiteAdjustment[ch]; s != nil {
+		v = s.Apply(v)
 	}
 	return v
 }
 
+//Range, open input and calibration flags for raw value on channel ch
+func (d *DelphinReceiver) valueQuality(ch uint8, raw float64) ek.Quality {
+	v := float64(raw/d.Profile.RawMax) * ek.ENG_MAX
+	q := ek.RangeQuality(v)
+	if int(ch) < len(d.OpenCircuit) {
+		q |= ek.OpenCircuitQuality(v, d.OpenCircuit[ch])
+	}
+	if d.AdjustmentTable[ch].Orders == 0 {
+		q |= ek.QUALITY_UNCALIBRATED
+	}
+	return q
+}
+
+//Inverse of engValue. Raw value for engineering value v on channel ch.
+func (d *DelphinReceiver) EngToRaw(ch uint8, v float64) float64 {
+	if s := d.SiteAdjustment[ch]; s != nil {
+		v = s.Unapply(v)
+	}
+	return ek.UnadjustValue(v, d.AdjustmentTable[ch]) / ek.ENG_MAX * d.Profile.RawMax
+}
+
+//Ask unit at addr for unit info on a short lived connection.
+//Used to find the model before setting up a receiver.
+func ProbeDelphin(addr string, timeout time.Duration) (DelphinUnitInfo, error) {
+	var info DelphinUnitInfo
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return info, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	binary.Write(conn, binary.BigEndian, &DelphinHeader{2, ek.CMD_INIT, 0x08, 0, 0, 0, 0})
+	binary.Write(conn, binary.BigEndian, &ek.DefaultInitRequest)
+	binary.Write(conn, binary.BigEndian, &DelphinHeader{2, ek.CMD_UNIT_INFO, 0x00, 0, 1, 0, 0})
+	for {
+		head, data, err := readPacket(conn)
+		if err != nil {
+			return info, err
+		}
+		if head.Com == ek.CMD_UNIT_INFO.Response() {
+			return parseUnitInfo(data)
+		}
+	}
+}
+
+//Probe unit and pick matching profile. Falls back to DefaultProfile.
+func ProbeProfile(addr string) *ek.DeviceProfile {
+	info, err := ProbeDelphin(addr, 5*time.Second)
+	if err != nil {
+		log.Printf("Could not probe %s: %s. Using %s profile\n", addr, err, ek.DefaultProfile.Name)
+		return ek.DefaultProfile
+	}
+	p := ek.LookupProfile(info.Model)
+	if p == nil {
+		log.Printf("Unknown model %s at %s. Using %s profile\n", info.Model, addr, ek.DefaultProfile.Name)
+		return ek.DefaultProfile
+	}
+	log.Printf("%s is %s (serial %s)\n", addr, p.Name, info.Serial)
+	return p
+}
+
 func readPacket(conn net.Conn) (DelphinHeader, []byte, error) {
 	var header DelphinHeader
 	err := binary.Read(conn, binary.BigEndian, &header)
@@ -225,15 +346,20 @@ func readPacket(conn net.Conn) (DelphinHeader, []byte, error) {
 
 //Send initial request for Init, Calib Data and Streaming
 func (d *DelphinReceiver) postConnect() {
-	request := &DelphinHeader{2, 0x2a, 0x08, 0, 0, 0, 0}
+	request := &DelphinHeader{2, ek.CMD_INIT, 0x08, 0, 0, 0, 0}
 	binary.Write(d.conn, binary.BigEndian, request)
-	d.conn.Write([]byte{0x03, 0x01, 0x00, 0x13, 0x00, 0x02, 0x00, 0x00}) // Init
-	request = &DelphinHeader{2, 0x48, 0x00, 0, 2, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, &ek.DefaultInitRequest)
+	request = &DelphinHeader{2, ek.CMD_UNIT_INFO, 0x00, 0, 1, 0, 0}
 	binary.Write(d.conn, binary.BigEndian, request)
-	request = &DelphinHeader{2, 0x01, 0, 0, 3, 0, 0}
+	request = &DelphinHeader{2, ek.CMD_CALIBRATION, 0x00, 0, 2, 0, 0}
 	binary.Write(d.conn, binary.BigEndian, request)
+	request = &DelphinHeader{2, ek.CMD_START, 0, 0, 3, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	request = &DelphinHeader{2, ek.CMD_SYNC, 0x0c, 0, 4, 0, 0}
+	binary.Write(d.conn, binary.BigEndian, request)
+	binary.Write(d.conn, binary.BigEndian, &ek.SyncRequest{Time: time.Now().UnixNano()})
 	d.connected = true
-	d.sequencenr = int32(4)
+	d.sequencenr = int32(5)
 }
 
 func (d *DelphinReceiver) connectDelphin() error {
@@ -245,6 +371,8 @@ func (d *DelphinReceiver) connectDelphin() error {
 		return err
 	}
 	log.Printf("Connected...\n")
+	d.Stats.Connect(time.Now())
+	d.Gaps.Reconnect()
 	d.postConnect()
 	return nil
 }
@@ -261,14 +389,25 @@ func (d *DelphinReceiver) receiverLoop() {
 			log.Printf("%s\n", err)
 			return
 		}
-		fmt.Printf("%#v\n", head);
-		switch {
-		case head.Com == 128: // Channel Data
+		samples := 0
+		if head.Com == ek.CMD_CHANNEL_DATA {
+			samples = len(data) / 8
+			if len(data)%8 != 0 {
+				d.Stats.DecodeError() //Partial sample, ignored
+			}
+		}
+		d.Stats.Packet(ptime, samples)
+		fmt.Printf("%#v\n", head)
+		switch head.Com {
+		case ek.CMD_CHANNEL_DATA:
+			if ptime.Sub(d.siteLoaded) >= ek.SITECAL_RELOAD {
+				d.loadSiteCalibration()
+			}
 			databuf := bytes.NewBuffer(data)
-			for databuf.Len() > 0 {
+			for databuf.Len() >= 8 {
 
 				var timestamp uint32
-				var chanvalue int32
+				var chanvalue uint32
 				var chvalue DelphinChannelData
 				if databuf.Len() == 8 {
 					chvalue.Last = true
@@ -276,31 +415,194 @@ func (d *DelphinReceiver) receiverLoop() {
 				binary.Read(databuf, binary.LittleEndian, &timestamp)
 				binary.Read(databuf, binary.LittleEndian, &chanvalue)
 				chvalue.Timestamp = timestamp
-				chvalue.Channel = uint8((chanvalue >> 27) & ((1 << 5) - 1))
-				chvalue.RawValue = chanvalue & ((1 << 23) - 1)
-				chvalue.RawValue = chvalue.RawValue << 9
+				chvalue.Channel = d.Profile.Channel(chanvalue)
+				if int(chvalue.Channel) >= d.Profile.Channels {
+					d.Stats.Drop()
+					continue
+				}
+				status, missing := d.Gaps.Check(chvalue.Channel, timestamp)
+				switch status {
+				case ek.SAMPLE_DUPLICATE, ek.SAMPLE_OUT_OF_ORDER:
+					d.Stats.Drop()
+					continue
+				case ek.SAMPLE_GAP:
+					log.Printf("Unit %s channel %d: %d samples missing\n", d.addr, chvalue.Channel, missing)
+				case ek.SAMPLE_RESTART:
+					log.Printf("Unit %s channel %d: timestamps started over\n", d.addr, chvalue.Channel)
+				}
+				chvalue.Status = status
+				chvalue.RawValue = d.Profile.RawValue(chanvalue)
+				chvalue.Word = chanvalue
 				chvalue.PacketTime = ptime
+				if t, ok := d.Clock.Time(timestamp); ok && chvalue.Last {
+					d.Stats.ClockOffset(ptime.Sub(t))
+				}
 				d.calc_chan <- chvalue
 			}
 			databuf.Reset()
-		case head.Com == -32696: //Calib Data
-			calib, err := NewCalibration(data[4:])
+		case ek.CMD_UNIT_INFO.Response():
+			info, err := parseUnitInfo(data)
 			if err != nil {
+				d.Stats.DecodeError()
 				log.Printf("%s\n", err)
+				break
+			}
+			d.UnitInfo = info
+			log.Printf("Unit %s: Serial %s Firmware %s\n", d.addr, info.Serial, info.Firmware)
+			if p := ek.LookupProfile(info.Model); p == nil {
+				log.Printf("Unknown model %s. Using %s profile\n", info.Model, d.Profile.Name)
+			} else if p != d.Profile {
+				log.Printf("Unit %s is %s but receiver was set up for %s\n", d.addr, p.Name, d.Profile.Name)
+			}
+			if d.Calibration == nil {
+				d.loadCalibration()
+			}
+			d.loadSiteCalibration()
+		case ek.CMD_CALIBRATION.Response():
+			d.handleCalibration(data)
+		case ek.CMD_SYNC.Response():
+			d.handleSync(data, ptime)
+		default:
+			if !head.Com.Known() && d.Unknown.Add(head.Com, data) == 1 {
+				log.Printf("Unknown command %s from %s (%d bytes)\n", head.Com, d.addr, len(data))
 			}
-			calib.AdjustmentTable(10, d.AdjustmentTable) //Convert to adjustment table
-			log.Printf("New adjustment table:\n%3s %16s %16s %16s %16s\n", "Chan", "Order0", "Order1", "Order2", "Order3")
-			//for v, _ := range d.AdjustmentTable {
-			//fmt.Printf("%3d ", v)
-			//for _, w := range d.AdjustmentTable[v].Order {
-			//	fmt.Printf("%16e ", w)
-			//}
-			//fmt.Printf("\n")
-			//}
 		}
 	}
 }
 
+//Update device clock from sync reply. Replies to requests from others (ekproxy clients) are ignored.
+func (d *DelphinReceiver) handleSync(data []byte, received time.Time) {
+	p, err := ek.DecodePayload(ek.CMD_SYNC.Response(), data)
+	if err != nil {
+		d.Stats.DecodeError()
+		log.Printf("%s\n", err)
+		return
+	}
+	r := p.(ek.SyncResponse)
+	sent := time.Unix(0, r.Time)
+	if rtt := received.Sub(sent); rtt < 0 || rtt > ek.MAX_SYNC_RTT {
+		return
+	}
+	first := !d.Clock.Synced()
+	if !d.Clock.Add(sent, received, r.Counter) {
+		log.Printf("Unit %s restarted. Clock estimate started over\n", d.addr)
+		d.Gaps.Restart()
+	}
+	if first {
+		log.Printf("Unit %s: uptime %v, rtt %v\n", d.addr, d.Clock.Uptime(), d.Clock.RTT())
+	}
+}
+
+//Calibration store key. Serial when known, address otherwise.
+func (d *DelphinReceiver) unitKey() string {
+	if d.UnitInfo.Serial != "" {
+		return d.UnitInfo.Serial
+	}
+	return d.addr
+}
+
+func (d *DelphinReceiver) parseCalibration(data []byte) (*ek.Calibration, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("calibration: short reply (%d bytes)", len(data))
+	}
+	calib, err := ek.NewCalibration(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	if err = calib.Validate(len(d.AdjustmentTable)); err != nil {
+		return nil, err
+	}
+	if err = calib.ValidateScale(d.Profile.Range, d.Profile.CoefficientScale[d.Profile.Range]); err != nil {
+		return nil, err
+	}
+	return calib, nil
+}
+
+//Validate and use calibration reply. Keeps last known good calibration if the reply is broken.
+func (d *DelphinReceiver) handleCalibration(data []byte) {
+	calib, err := d.parseCalibration(data)
+	if err != nil {
+		d.Stats.DecodeError()
+		log.Printf("Bad calibration from %s: %s\n", d.addr, err)
+		if d.Calibration == nil {
+			d.loadCalibration()
+		}
+		if d.Calibration == nil {
+			log.Printf("No calibration for %s. Values are not adjusted\n", d.addr)
+		}
+		return
+	}
+	prev := d.Calibration
+	if prev == nil && d.CalibStore != nil {
+		prev, _ = d.CalibStore.Load(d.unitKey(), len(d.AdjustmentTable))
+	}
+	if prev != nil {
+		for _, l := range prev.Diff(calib) {
+			log.Printf("Calibration changed for %s: %s\n", d.unitKey(), l)
+		}
+	}
+	if d.CalibStore != nil {
+		if err := d.CalibStore.Save(d.unitKey(), data[4:]); err != nil {
+			log.Printf("Could not store calibration: %s\n", err)
+		}
+	}
+	d.applyCalibration(calib)
+}
+
+//Use stored calibration for this unit if there is one
+func (d *DelphinReceiver) loadCalibration() {
+	if d.CalibStore == nil {
+		return
+	}
+	calib, err := d.CalibStore.Load(d.unitKey(), len(d.AdjustmentTable))
+	if err != nil {
+		log.Printf("No stored calibration for %s: %s\n", d.unitKey(), err)
+		return
+	}
+	log.Printf("Using stored calibration for %s from %s\n", d.unitKey(), calib.Adjustment.Date)
+	d.applyCalibration(calib)
+}
+
+//Use field calibration records for this unit. Also called every SITECAL_RELOAD
+//while streaming, so new records and records dated ahead take effect.
+func (d *DelphinReceiver) loadSiteCalibration() {
+	d.siteLoaded = time.Now()
+	if d.SiteCalStore == nil {
+		return
+	}
+	records, err := d.SiteCalStore.Load()
+	if err != nil {
+		log.Printf("Could not load site calibration: %s\n", err)
+		return
+	}
+	active := ek.ActiveSiteCalibration(records, d.unitKey(), len(d.SiteAdjustment), d.siteLoaded)
+	for ch, s := range active {
+		if s != nil && (d.SiteAdjustment[ch] == nil || d.SiteAdjustment[ch].ID != s.ID) {
+			log.Printf("Site calibration %s\n", s)
+		}
+	}
+	copy(d.SiteAdjustment, active)
+}
+
+//Convert calibration to adjustment table
+func (d *DelphinReceiver) applyCalibration(calib *ek.Calibration) {
+	adjt := make([]ek.AdjustmentTable, len(d.AdjustmentTable))
+	if err := calib.AdjustmentTable(d.Profile.Range, d.Profile.CoefficientScale[d.Profile.Range], adjt); err != nil {
+		log.Printf("Calibration for %s not used: %s\n", d.unitKey(), err)
+		return
+	}
+	copy(d.AdjustmentTable, adjt)
+	d.Calibration = calib
+	log.Printf("New adjustment table:\n%3s %16s %16s %16s %16s\n", "Chan", "Order0", "Order1", "Order2", "Order3")
+	//for v, _ := range d.AdjustmentTable {
+	//fmt.Printf("%3d ", v)
+	//for _, w := range d.AdjustmentTable[v].Order {
+	//	fmt.Printf("%16e ", w)
+	//}
+	//fmt.Printf("\n")
+	//}
+}
+
 //Start streaming data from Delphin device.
 //Never returns. Will handle d.connection errors by red.connecting.
 func (d *DelphinReceiver) Start() {
@@ -308,6 +610,7 @@ func (d *DelphinReceiver) Start() {
 		err := d.connectDelphin()
 		if err == nil {
 			d.receiverLoop()
+			d.connected = false
 			d.conn.Close()
 		}
 		log.Printf("Socket Read Error... Reconnecting\n")
@@ -315,37 +618,51 @@ func (d *DelphinReceiver) Start() {
 	}
 }
 
-func (d *DelphinReceiver) foo() {
-	time.Sleep(10 * time.Second)
-	request := &DelphinHeader{2, 0x01, 0, 0, d.sequencenr, 0, 0}
-	binary.Write(d.conn, binary.BigEndian, request)
-	d.sequencenr = d.sequencenr + 1
+//Log stale and flatline channels
+func (d *DelphinReceiver) watch() {
+	t := time.NewTicker(ek.WATCHDOG_INTERVAL)
+	for now := range t.C {
+		for _, c := range d.Watchdog.Check(now) {
+			if c.To == ek.CONDITION_OK {
+				log.Printf("Unit %s channel %d: %s cleared\n", d.addr, c.Channel, c.From)
+			} else {
+				log.Printf("Unit %s channel %d: %s\n", d.addr, c.Channel, c.To)
+			}
+		}
+	}
 }
 
 //Init set up everything needed for receiving data.
 func NewDelphinReceiver(addr string) *DelphinReceiver {
+	return NewDelphinReceiverProfile(addr, ek.DefaultProfile)
+}
+
+//Set up receiver for unit model p
+func NewDelphinReceiverProfile(addr string, p *ek.DeviceProfile) *DelphinReceiver {
 	d := new(DelphinReceiver)
 	d.addr = addr
+	d.Profile = p
 	d.FIRTaps = 400
 	d.SampleTime = 1000 * time.Millisecond
-	d.calc_chan = make(chan DelphinChannelData, 100)   //Value calculations
-	d.buffer_chan = make(chan DelphinChannelData, 100) //Value buffer
-	d.ValueBufferRaw = make([]*ring.Ring, 31)          //Should be faster and smaller then a map
-	d.ValueBuffer = make([]*ring.Ring, 31)             //Should be faster and smaller then a map
-	d.AdjustmentTable = make([]AdjustmentTable, 31)    //Should be faster and smaller then a map
-	go valueCalc(d)                                    // Send calculated values to buffer
-//	go d.foo()
-	go valueBuffer(d)                                  // Buffer Storage
+	d.calc_chan = make(chan DelphinChannelData, 100)           //Value calculations
+	d.buffer_chan = make(chan DelphinChannelData, 100)         //Value buffer
+	d.ValueBufferRaw = make([]*ring.Ring, p.Channels)          //Should be faster and smaller then a map
+	d.ValueBuffer = make([]*ring.Ring, p.Channels)             //Should be faster and smaller then a map
+	d.AdjustmentTable = make([]ek.AdjustmentTable, p.Channels) //Should be faster and smaller then a map
+	d.SiteAdjustment = make([]*ek.SiteCalibration, p.Channels)
+	d.Gaps = ek.NewSampleTracker(p.Channels)
+	d.Watchdog = ek.NewWatchdog(p.Channels, p.LSB()*p.LSB())
+	go valueCalc(d)   // Send calculated values to buffer
+	go valueBuffer(d) // Buffer Storage
+	go d.watch()
 	//Send "Ping" Packets
 	go func() {
-		t := time.NewTicker(10*time.Second)
+		t := time.NewTicker(10 * time.Second)
 		for {
 			if d.connected {
-				syncreq := &DelphinHeader{2, 0x20, 0x0c, 0, d.sequencenr, 0, 0}
-				tn := time.Now()
+				syncreq := &DelphinHeader{2, ek.CMD_SYNC, 0x0c, 0, d.sequencenr, 0, 0}
 				binary.Write(d.conn, binary.BigEndian, syncreq)
-				d.conn.Write([]byte{0, 0, 0, 0})
-				binary.Write(d.conn, binary.BigEndian, tn.UnixNano())
+				binary.Write(d.conn, binary.BigEndian, &ek.SyncRequest{Time: time.Now().UnixNano()})
 				d.sequencenr++
 			}
 			<-t.C
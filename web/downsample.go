@@ -0,0 +1,188 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Server side downsampling for charts. A chart is a few hundred pixels
+// wide, there is no point in sending it 20000 values, but plain decimation
+// loses the spikes and voltage drops the charts are there to show.
+//
+//	max_points  at most this many points per series, 0 or missing is all
+//	downsample  lttb (default), minmax or avg
+//
+// lttb is Largest-Triangle-Three-Buckets: one real value per bucket, the
+// one that keeps the shape of the line. minmax keeps the smallest and the
+// largest value of each bucket, so no peak is lost. avg is the mean of each
+// bucket, smooth but peaks are flattened.
+//
+// A point standing in for a bucket has the quality of all values in it, and
+// the gap flag if any of them had one.
+
+package main
+
+import (
+	"delphin/ek"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DOWNSAMPLE_LTTB   = "lttb"
+	DOWNSAMPLE_MINMAX = "minmax"
+	DOWNSAMPLE_AVG    = "avg"
+)
+
+//max_points and downsample parameters
+func downsampleParams(r *http.Request) (int, string, error) {
+	n := 0
+	if s := r.FormValue("max_points"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			return 0, "", fmt.Errorf("bad max_points %q", s)
+		}
+	}
+	switch method := r.FormValue("downsample"); method {
+	case "":
+		return n, DOWNSAMPLE_LTTB, nil
+	case DOWNSAMPLE_LTTB, DOWNSAMPLE_MINMAX, DOWNSAMPLE_AVG:
+		return n, method, nil
+	}
+	return 0, "", fmt.Errorf("unknown downsample %q, want lttb, minmax or avg", r.FormValue("downsample"))
+}
+
+//points reduced to at most n with method. Order of points is kept,
+//oldest or newest first does not matter.
+func downsample(points []ek.ChannelData, n int, method string) []ek.ChannelData {
+	if n <= 0 || len(points) <= n {
+		return points
+	}
+	switch method {
+	case DOWNSAMPLE_MINMAX:
+		return minMaxBuckets(points, n)
+	case DOWNSAMPLE_AVG:
+		return avgBuckets(points, n)
+	}
+	return lttb(points, n)
+}
+
+//Bucket b of buckets over l points
+func bucket(l, buckets, b int) (int, int) {
+	return b * l / buckets, (b + 1) * l / buckets
+}
+
+//p with the quality and gap flag of all points in bucket
+func merged(bucket []ek.ChannelData, p ek.ChannelData) ek.ChannelData {
+	for _, cd := range bucket {
+		p.Quality |= cd.Quality
+		p.Gap = p.Gap || cd.Gap
+	}
+	return p
+}
+
+func lttb(points []ek.ChannelData, n int) []ek.ChannelData {
+	if n < 3 {
+		return avgBuckets(points, n)
+	}
+	x := func(i int) float64 { return points[i].Timestamp.Sub(points[0].Timestamp).Seconds() }
+	//First and last are kept, the rest in n-2 buckets
+	inner := len(points) - 2
+	out := make([]ek.ChannelData, 0, n)
+	out = append(out, points[0])
+	a := 0
+	for b := 0; b < n-2; b++ {
+		start, end := bucket(inner, n-2, b)
+		start, end = start+1, end+1
+		//Third corner is the average of the next bucket, or the last point
+		next_end := len(points)
+		if b < n-3 {
+			_, next_end = bucket(inner, n-2, b+1)
+			next_end++
+		}
+		var ax, ay float64
+		for j := end; j < next_end; j++ {
+			ax += x(j)
+			ay += points[j].Value
+		}
+		ax /= float64(next_end - end)
+		ay /= float64(next_end - end)
+		best, area := start, -1.0
+		for j := start; j < end; j++ {
+			ar := math.Abs((x(a)-ax)*(points[j].Value-points[a].Value) - (x(a)-x(j))*(ay-points[a].Value))
+			if ar > area {
+				best, area = j, ar
+			}
+		}
+		out = append(out, merged(points[start:end], points[best]))
+		a = best
+	}
+	return append(out, points[len(points)-1])
+}
+
+//Smallest and largest of every bucket, in the order they came
+func minMaxBuckets(points []ek.ChannelData, n int) []ek.ChannelData {
+	if n < 2 {
+		return avgBuckets(points, n)
+	}
+	buckets := n / 2
+	out := make([]ek.ChannelData, 0, 2*buckets)
+	for b := 0; b < buckets; b++ {
+		start, end := bucket(len(points), buckets, b)
+		lo, hi := start, start
+		for j := start; j < end; j++ {
+			if points[j].Value < points[lo].Value {
+				lo = j
+			}
+			if points[j].Value > points[hi].Value {
+				hi = j
+			}
+		}
+		first, last := lo, hi
+		if hi < lo {
+			first, last = hi, lo
+		}
+		out = append(out, merged(points[start:end], points[first]))
+		if last != first {
+			out = append(out, points[last])
+		}
+	}
+	return out
+}
+
+//Mean of every bucket, at the middle of its time span
+func avgBuckets(points []ek.ChannelData, n int) []ek.ChannelData {
+	out := make([]ek.ChannelData, 0, n)
+	for b := 0; b < n; b++ {
+		start, end := bucket(len(points), n, b)
+		var sum float64
+		for _, cd := range points[start:end] {
+			sum += cd.Value
+		}
+		p := points[start]
+		p.Timestamp = p.Timestamp.Add(points[end-1].Timestamp.Sub(p.Timestamp) / 2)
+		p.Value = sum / float64(end-start)
+		out = append(out, merged(points[start:end], p))
+	}
+	return out
+}
+
+//One value for a slot of the batch time axis. avg gives the mean, the
+//others the value farthest from the mean so spikes survive.
+func slotValue(values []ek.ChannelData, method string) ek.ChannelData {
+	var sum float64
+	for _, cd := range values {
+		sum += cd.Value
+	}
+	mean := sum / float64(len(values))
+	p := values[0]
+	if method == DOWNSAMPLE_AVG {
+		p.Value = mean
+	} else {
+		for _, cd := range values {
+			if math.Abs(cd.Value-mean) > math.Abs(p.Value-mean) {
+				p.Value = cd.Value
+			}
+		}
+	}
+	return merged(values, p)
+}
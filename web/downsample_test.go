@@ -0,0 +1,184 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"delphin/ek"
+	"math"
+	"testing"
+	"time"
+)
+
+var downsampleStart = time.Date(2015, 10, 5, 14, 0, 0, 0, time.UTC)
+
+//Points one second apart
+func testPoints(values ...float64) []ek.ChannelData {
+	points := make([]ek.ChannelData, len(values))
+	for i, v := range values {
+		points[i] = ek.ChannelData{Timestamp: downsampleStart.Add(time.Duration(i) * time.Second), Value: v}
+	}
+	return points
+}
+
+//100 points of 0 with a spike of 50 at 37 and a dip of -20 at 71
+func spiky() []ek.ChannelData {
+	values := make([]float64, 100)
+	values[37] = 50
+	values[71] = -20
+	return testPoints(values...)
+}
+
+func pointValues(points []ek.ChannelData) []float64 {
+	values := make([]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Value
+	}
+	return values
+}
+
+func hasValue(points []ek.ChannelData, v float64) bool {
+	for _, p := range points {
+		if p.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+//Buckets are contiguous, cover every point and differ in size by at most one
+func TestBucket(t *testing.T) {
+	for _, c := range []struct{ l, buckets int }{{10, 3}, {100, 7}, {7, 7}, {5, 2}, {1000, 999}, {3, 1}} {
+		next, small, large := 0, c.l, 0
+		for b := 0; b < c.buckets; b++ {
+			start, end := bucket(c.l, c.buckets, b)
+			if start != next || end <= start {
+				t.Errorf("bucket(%d, %d, %d) = %d, %d after %d", c.l, c.buckets, b, start, end, next)
+			}
+			if n := end - start; n < small {
+				small = n
+			}
+			if n := end - start; n > large {
+				large = n
+			}
+			next = end
+		}
+		if next != c.l || large-small > 1 {
+			t.Errorf("buckets of %d over %d: end %d, sizes %d to %d", c.buckets, c.l, next, small, large)
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		points []ek.ChannelData
+		n      int
+		method string
+		want   []float64 //nil to only check length and peaks
+		max    int       //Most points expected
+		peaks  []float64 //Values that must survive
+	}{
+		{"all", testPoints(1, 2, 3), 3, DOWNSAMPLE_LTTB, []float64{1, 2, 3}, 3, nil},
+		{"no limit", testPoints(1, 2, 3), 0, DOWNSAMPLE_MINMAX, []float64{1, 2, 3}, 3, nil},
+		{"lttb", spiky(), 10, DOWNSAMPLE_LTTB, nil, 10, []float64{50, -20}},
+		{"lttb ends", testPoints(5, 1, 1, 1, 1, 1, 1, 9), 4, DOWNSAMPLE_LTTB, nil, 4, []float64{5, 9}},
+		{"lttb n=2", testPoints(1, 3, 5, 7), 2, DOWNSAMPLE_LTTB, []float64{2, 6}, 2, nil},
+		{"lttb n=1", testPoints(1, 3, 5, 7), 1, DOWNSAMPLE_LTTB, []float64{4}, 1, nil},
+		{"minmax", spiky(), 10, DOWNSAMPLE_MINMAX, nil, 10, []float64{50, -20}},
+		{"minmax odd", spiky(), 5, DOWNSAMPLE_MINMAX, nil, 4, []float64{50, -20}},
+		{"minmax n=2", testPoints(3, 9, 1, 4), 2, DOWNSAMPLE_MINMAX, []float64{9, 1}, 2, nil},
+		{"minmax order", testPoints(3, 1, 4, 1, 5, 9, 2, 6), 4, DOWNSAMPLE_MINMAX, []float64{1, 4, 9, 2}, 4, nil},
+		{"minmax flat", testPoints(2, 2, 2, 2), 2, DOWNSAMPLE_MINMAX, []float64{2}, 1, nil},
+		{"minmax n=1", testPoints(1, 3, 5, 7), 1, DOWNSAMPLE_MINMAX, []float64{4}, 1, nil},
+		{"avg", testPoints(1, 3, 5, 7, 9, 11), 3, DOWNSAMPLE_AVG, []float64{2, 6, 10}, 3, nil},
+		{"avg uneven", testPoints(1, 2, 3, 4, 5), 2, DOWNSAMPLE_AVG, []float64{1.5, 4}, 2, nil},
+	} {
+		got := downsample(c.points, c.n, c.method)
+		if len(got) > c.max {
+			t.Errorf("%s: %d points, want at most %d", c.name, len(got), c.max)
+		}
+		if c.want != nil {
+			values := pointValues(got)
+			if len(values) != len(c.want) {
+				t.Errorf("%s: got %v, want %v", c.name, values, c.want)
+				continue
+			}
+			for i := range values {
+				if math.Abs(values[i]-c.want[i]) > 1e-9 {
+					t.Errorf("%s: got %v, want %v", c.name, values, c.want)
+					break
+				}
+			}
+		}
+		for _, p := range c.peaks {
+			if !hasValue(got, p) {
+				t.Errorf("%s: lost %g in %v", c.name, p, pointValues(got))
+			}
+		}
+		for i := 1; i < len(got); i++ {
+			if !got[i].Timestamp.After(got[i-1].Timestamp) {
+				t.Errorf("%s: point %d at %s is not after %s", c.name, i, got[i].Timestamp, got[i-1].Timestamp)
+			}
+		}
+	}
+}
+
+//A point standing in for a bucket carries the flags of every value in it
+func TestDownsampleFlags(t *testing.T) {
+	for _, method := range []string{DOWNSAMPLE_LTTB, DOWNSAMPLE_MINMAX, DOWNSAMPLE_AVG} {
+		points := spiky()
+		points[40].Quality = ek.QUALITY_INTERPOLATED
+		points[41].Gap = true
+		got := downsample(points, 10, method)
+		var q ek.Quality
+		gap := false
+		for _, p := range got {
+			q |= p.Quality
+			gap = gap || p.Gap
+		}
+		if q != ek.QUALITY_INTERPOLATED || !gap {
+			t.Errorf("%s: quality %s gap %v after downsampling", method, q, gap)
+		}
+	}
+}
+
+//avg buckets are stamped at the middle of their span
+func TestAvgBucketsTime(t *testing.T) {
+	got := avgBuckets(testPoints(1, 2, 3, 4, 5, 6), 2)
+	for i, want := range []time.Duration{time.Second, 4 * time.Second} {
+		if d := got[i].Timestamp.Sub(downsampleStart); d != want {
+			t.Errorf("bucket %d at %v, want %v", i, d, want)
+		}
+	}
+}
+
+func TestSlotValue(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		values []float64
+		method string
+		want   float64
+	}{
+		{"single", []float64{4}, DOWNSAMPLE_LTTB, 4},
+		{"single avg", []float64{4}, DOWNSAMPLE_AVG, 4},
+		{"avg", []float64{1, 2, 6}, DOWNSAMPLE_AVG, 3},
+		{"spike", []float64{1, 1, 10, 1}, DOWNSAMPLE_LTTB, 10},
+		{"dip", []float64{5, 5, -3, 5}, DOWNSAMPLE_MINMAX, -3},
+		{"first of equals", []float64{2, 4}, DOWNSAMPLE_LTTB, 2},
+	} {
+		values := testPoints(c.values...)
+		values[len(values)-1].Quality = ek.QUALITY_OVER_RANGE
+		got := slotValue(values, c.method)
+		if math.Abs(got.Value-c.want) > 1e-9 {
+			t.Errorf("%s: %g, want %g", c.name, got.Value, c.want)
+		}
+		if got.Quality != ek.QUALITY_OVER_RANGE {
+			t.Errorf("%s: quality %s", c.name, got.Quality)
+		}
+		if !got.Timestamp.Equal(downsampleStart) {
+			t.Errorf("%s: time %s, want the first of the slot", c.name, got.Timestamp)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ETag for responses that are rebuilt from the buffers on every request.
+// The body is still built, but a client that has it already gets a 304
+// instead of all the points again.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+type etagResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *etagResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *etagResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+//If-None-Match matches etag, with weak comparison
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//Wrap h to buffer its response and tag it with a hash of the body.
+//Goes outside gzHandler, so gzip and plain responses have different tags.
+func withETag(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ew := &etagResponseWriter{ResponseWriter: w}
+		h(ew, r)
+		if ew.status == 0 {
+			ew.status = http.StatusOK
+		}
+		if ew.status == http.StatusOK {
+			sum := fnv.New64a()
+			sum.Write(ew.body.Bytes())
+			etag := fmt.Sprintf("\"%x\"", sum.Sum64())
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "no-cache")
+			if etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Del("Content-Type")
+				w.Header().Del("Content-Encoding")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.WriteHeader(ew.status)
+		w.Write(ew.body.Bytes())
+	}
+}
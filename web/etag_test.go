@@ -0,0 +1,71 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestETagMatch(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		match  bool
+	}{
+		{``, false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"abd"`, false},
+		{`abc`, false},
+		{`"x", "abc"`, true},
+		{`"x",W/"abc"`, true},
+		{`"x", "y"`, false},
+		{`*`, true},
+	} {
+		if got := etagMatch(c.header, `"abc"`); got != c.match {
+			t.Errorf("If-None-Match %s: %v, want %v", c.header, got, c.match)
+		}
+	}
+}
+
+func TestETag304(t *testing.T) {
+	a := testServer(1, 2, 3)
+	h := withETag(gzHandler(a.ServeHTTP))
+	url := API_PREFIX + "units/0/channels/0/samples"
+
+	w := testGet(t, h, url)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.Len() == 0 {
+		t.Fatalf("first request: %d, etag %q, %d bytes", w.Code, etag, w.Body.Len())
+	}
+	w = testGet(t, h, url, "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("unchanged: %d, %d bytes, type %q", w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+	}
+	if got := w.Header().Get("ETag"); got != etag {
+		t.Errorf("304 has etag %q, want %q", got, etag)
+	}
+
+	//gzip is tagged apart, it is a different body
+	w = testGet(t, h, url, "If-None-Match", etag, "Accept-Encoding", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("gzip: %d, etag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	//New value, new tag
+	buf := a.slow_buffer[0][0].Next()
+	buf.Value = a.slow_buffer[0][0].Value
+	a.slow_buffer[0][0] = buf
+	w = testGet(t, h, url, "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("changed: %d, etag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	//Errors are not tagged
+	w = testGet(t, h, API_PREFIX+"units/9", "If-None-Match", "*")
+	if w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" {
+		t.Errorf("error: %d, etag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
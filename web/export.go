@@ -0,0 +1,125 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Export of channels and a time range for spreadsheets. ekexport is the
+// command line for it.
+//
+//	GET /export/csv?channels=&group=&from=&to=&resolution=&decimal=&sep=&tz=
+//	GET /export/xlsx?channels=&group=&from=&to=&resolution=&tz=
+//
+// Channel selection, times, resolution and max_points are as for
+// /api/v1/series (batch.go), all channels are on one time axis. Every
+// channel has a value column headed with its name, unit:channel and
+// engineering unit, and a quality column. Times are written in tz, UTC by
+// default.
+//
+// CSV only: decimal=comma writes 1234,5 and makes ; the default separator,
+// as Excel expects with Norwegian settings. sep sets the separator, tab for
+// tab separated.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EXPORT_TIME = "2006-01-02 15:04:05.000"
+
+//Value and quality column headings of a channel
+func (a *apiServer) exportHeadings(s Subscription) (string, string) {
+	ch := a.channel(s.Unit, s.Channel)
+	h := fmt.Sprintf("%d:%d", s.Unit, s.Channel)
+	if ch.Name != "" {
+		h = ch.Name + " (" + h + ")"
+	}
+	return h + " [" + ch.Units + "]", h + " quality"
+}
+
+func (a *apiServer) export(w http.ResponseWriter, r *http.Request) {
+	format := strings.Trim(strings.TrimPrefix(r.URL.Path, "/export"), "/")
+	if format != "csv" && format != "xlsx" {
+		apiError(w, http.StatusNotFound, "no export format %q, want csv or xlsx", format)
+		return
+	}
+	q, ok := a.batchParams(w, r)
+	if !ok {
+		return
+	}
+	comma, decimal := ',', "."
+	switch r.FormValue("decimal") {
+	case "", "point":
+	case "comma":
+		comma, decimal = ';', ","
+	default:
+		apiError(w, http.StatusBadRequest, "unknown decimal %q, want point or comma", r.FormValue("decimal"))
+		return
+	}
+	switch sep := r.FormValue("sep"); {
+	case sep == "":
+	case sep == "tab":
+		comma = '\t'
+	case len(sep) == 1 && sep != decimal && sep != "\"":
+		comma = rune(sep[0])
+	default:
+		apiError(w, http.StatusBadRequest, "bad sep %q", sep)
+		return
+	}
+	loc := q.tf.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	al := a.align(q)
+
+	header := []string{"time (" + loc.String() + ")"}
+	for _, s := range q.sel {
+		value, quality := a.exportHeadings(s)
+		header = append(header, value, quality)
+	}
+	rows := make([][]interface{}, len(al.Times))
+	for j, t := range al.Times {
+		row := []interface{}{time.Unix(0, t*int64(time.Millisecond)).In(loc)}
+		for i := range q.sel {
+			if cd := al.Values[i][j]; cd != nil {
+				row = append(row, cd.Value, cd.Quality.String())
+			} else {
+				row = append(row, nil, nil)
+			}
+		}
+		rows[j] = row
+	}
+
+	name := "export-" + time.Now().UTC().Format("20060102T150405Z") + "." + format
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		writeXLSX(w, header, rows)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	cw.Write(header)
+	record := make([]string, len(header))
+	for _, row := range rows {
+		for i, v := range row {
+			switch v := v.(type) {
+			case time.Time:
+				record[i] = v.Format(EXPORT_TIME)
+			case float64:
+				record[i] = strings.Replace(strconv.FormatFloat(v, 'f', -1, 64), ".", decimal, 1)
+			case string:
+				record[i] = v
+			default:
+				record[i] = ""
+			}
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportCSV(t *testing.T) {
+	a := testServer(1234.5, -0.25, 7)
+	for _, c := range []struct {
+		name  string
+		query string
+		lines []string
+	}{
+		{"point", "channels=0:0,0:1&to=2015-10-05T14:00:10Z", []string{
+			"time (UTC),0:0 [mV],0:0 quality,0:1 [mV],0:1 quality",
+			"2015-10-05 14:00:00.000,1234.5,good,1235.5,good",
+			"2015-10-05 14:00:10.000,-0.25,good,0.75,good",
+		}},
+		{"comma", "channels=0:0,0:1&decimal=comma&to=2015-10-05T14:00:10Z", []string{
+			"time (UTC);0:0 [mV];0:0 quality;0:1 [mV];0:1 quality",
+			"2015-10-05 14:00:00.000;1234,5;good;1235,5;good",
+			"2015-10-05 14:00:10.000;-0,25;good;0,75;good",
+		}},
+		{"comma tab", "channels=0:0&decimal=comma&sep=tab&from=2015-10-05T14:00:20Z", []string{
+			"time (UTC)\t0:0 [mV]\t0:0 quality",
+			"2015-10-05 14:00:20.000\t7\tgood",
+		}},
+		{"comma local", "channels=0:0&decimal=comma&tz=Europe/Oslo&from=2015-10-05T14:00:10Z&to=2015-10-05T14:00:10Z", []string{
+			"time (Europe/Oslo);0:0 [mV];0:0 quality",
+			"2015-10-05 16:00:10.000;-0,25;good",
+		}},
+	} {
+		if _, err := time.LoadLocation("Europe/Oslo"); err != nil && strings.Contains(c.query, "tz=") {
+			continue
+		}
+		w := testGet(t, a.export, "/export/csv?"+c.query)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: %d %s", c.name, w.Code, w.Body)
+			continue
+		}
+		if got, want := w.Body.String(), strings.Join(c.lines, "\n")+"\n"; got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", c.name, got, want)
+		}
+	}
+	for _, q := range []string{"decimal=comma&sep=,", "decimal=dot", "sep=ab"} {
+		if w := testGet(t, a.export, "/export/csv?channels=0:0&"+q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want 400", q, w.Code)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Prometheus text exposition format on /metrics.
+// Written by hand, the format is simple and it saves a dependency.
+
+package main
+
+import (
+	"bytes"
+	"container/ring"
+	"delphin/ek"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Upper bounds in seconds
+var HTTP_BUCKETS = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+var DB_BUCKETS = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 //Per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+//Write histogram series. labels is empty or `name="value",...`
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	n := uint64(0)
+	for i, b := range h.buckets {
+		n += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, b, n)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+//Histograms by label value
+type HistogramVec struct {
+	mu      sync.Mutex
+	label   string
+	buckets []float64
+	h       map[string]*Histogram
+}
+
+func NewHistogramVec(label string, buckets []float64) *HistogramVec {
+	return &HistogramVec{label: label, buckets: buckets, h: make(map[string]*Histogram)}
+}
+
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.h[value]
+	if !ok {
+		h = NewHistogram(v.buckets)
+		v.h[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.h))
+	for k := range v.h {
+		values = append(values, k)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+	for _, k := range values {
+		v.With(k).write(w, name, fmt.Sprintf("%s=%q", v.label, k))
+	}
+}
+
+var httpDuration = NewHistogramVec("path", HTTP_BUCKETS)
+var dbWriteDuration = NewHistogram(DB_BUCKETS)
+
+//Time handler into httpDuration
+func instrument(path string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h(w, r)
+		httpDuration.With(path).Observe(time.Since(start).Seconds())
+	}
+}
+
+func help(w io.Writer, name, typ, text string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, text, name, typ)
+}
+
+//Sample value as Prometheus writes it
+func metricValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//Newest value in ring, ok false if there is none
+func latest(r *ring.Ring) (ek.ChannelData, bool) {
+	if r == nil || r.Value == nil {
+		return ek.ChannelData{}, false
+	}
+	return r.Value.(ek.ChannelData), true
+}
+
+func metricsHandler(del []*DelphinReceiver, std_dev [][]*ring.Ring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		out := new(bytes.Buffer)
+		stats := make([]ek.StatsSnapshot, len(del))
+		for i, d := range del {
+			stats[i] = d.Stats.Snapshot()
+		}
+		unit := func(i int) string {
+			return fmt.Sprintf("unit=\"%d\",address=%q", i, del[i].addr)
+		}
+		perUnit := func(name, typ, text string, f func(int, *DelphinReceiver) float64) {
+			help(out, name, typ, text)
+			for i, d := range del {
+				fmt.Fprintf(out, "%s{%s} %s\n", name, unit(i), metricValue(f(i, d)))
+			}
+		}
+		perUnit("ek_unit_connected", "gauge", "1 if connected to the unit.",
+			func(i int, d *DelphinReceiver) float64 { return boolValue(d.connected) })
+		perUnit("ek_frames_received_total", "counter", "Frames received from the unit.",
+			func(i int, d *DelphinReceiver) float64 { return float64(stats[i].Packets) })
+		perUnit("ek_samples_received_total", "counter", "Samples received from the unit.",
+			func(i int, d *DelphinReceiver) float64 { return float64(stats[i].Samples) })
+		perUnit("ek_samples_dropped_total", "counter", "Duplicate, out of order or unknown channel samples.",
+			func(i int, d *DelphinReceiver) float64 { return float64(stats[i].Dropped) })
+		perUnit("ek_samples_missing_total", "counter", "Samples estimated missing in timestamp gaps.",
+			func(i int, d *DelphinReceiver) float64 {
+				n := uint64(0)
+				for _, c := range d.Gaps.Counters() {
+					n += c.Missing
+				}
+				return float64(n)
+			})
+		perUnit("ek_decode_errors_total", "counter", "Frames or payloads that could not be decoded.",
+			func(i int, d *DelphinReceiver) float64 { return float64(stats[i].DecodeErrors) })
+		perUnit("ek_reconnects_total", "counter", "Connections to the unit after the first.",
+			func(i int, d *DelphinReceiver) float64 { return float64(stats[i].Reconnects) })
+		perUnit("ek_last_frame_timestamp_seconds", "gauge", "Time of the last frame. 0 if none.",
+			func(i int, d *DelphinReceiver) float64 {
+				if stats[i].LastPacket.IsZero() {
+					return 0
+				}
+				return float64(stats[i].LastPacket.UnixNano()) / 1e9
+			})
+		perUnit("ek_clock_drift_ppm", "gauge", "Unit clock rate error from sync replies.",
+			func(i int, d *DelphinReceiver) float64 { return (d.Clock.Rate()/ek.DEVICE_CLOCK_HZ - 1) * 1e6 })
+		perUnit("ek_clock_offset_seconds", "gauge", "Arrival of the last sample minus its unit clock time.",
+			func(i int, d *DelphinReceiver) float64 { return stats[i].ClockOffset.Seconds() })
+
+		perChannel := func(name, text string, f func(int, int) (float64, bool)) {
+			help(out, name, "gauge", text)
+			for i, d := range del {
+				for ch := 0; ch < d.Profile.Channels; ch++ {
+					if v, ok := f(i, ch); ok {
+						fmt.Fprintf(out, "%s{%s,channel=\"%d\"} %s\n", name, unit(i), ch, metricValue(v))
+					}
+				}
+			}
+		}
+		perChannel("ek_channel_value_millivolts", "Latest filtered value.", func(i, ch int) (float64, bool) {
+			cd, ok := latest(del[i].ValueBuffer[ch])
+			return cd.Value, ok
+		})
+		perChannel("ek_channel_stddev_millivolts", "Latest standard deviation.", func(i, ch int) (float64, bool) {
+			cd, ok := latest(std_dev[i][ch])
+			return cd.Value, ok
+		})
+		perChannel("ek_channel_quality", "Quality flags of the latest value, 0 is good.", func(i, ch int) (float64, bool) {
+			cd, ok := latest(del[i].ValueBuffer[ch])
+			return float64(cd.Quality | del[i].Watchdog.Condition(uint8(ch)).Quality()), ok
+		})
+
+		help(out, "ek_http_request_duration_seconds", "histogram", "HTTP handler latency.")
+		httpDuration.write(out, "ek_http_request_duration_seconds")
+		help(out, "ek_db_write_duration_seconds", "histogram", "Time to write a round of values to the database.")
+		dbWriteDuration.write(out, "ek_db_write_duration_seconds", "")
+		out.WriteTo(w)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Live push of samples as they arrive, over Server-Sent Events
+// (/push/sse) and WebSocket (/push/ws).
+//
+// Query parameters:
+//	channels    unit:channel list, comma separated. unit:* for all channels
+//	            of a unit. Default is all channels of all units.
+//	raw         1 for every raw sample instead of filtered values
+//	resolution  fast (filtered values, default) or slow (the averages of
+//	            /json/slow every SLOW_INTERVAL, with their stddev)
+//	tz          as for api.go, local shifts time to the wall clock
+//
+// Every sample is sent as one JSON object:
+//	{"unit":0,"channel":3,"time":1444056000123,"value":1234.5,"quality":"good"}
+// Slow samples add "stddev". time is UTC milliseconds since the epoch
+// unless tz is given. A client that can not keep up loses samples rather
+// than slowing down acquisition.
+
+package main
+
+import (
+	"delphin/ek"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PUSH_QUEUE     = 1000             //Samples queued per client
+	PUSH_KEEPALIVE = 15 * time.Second //SSE comment or WebSocket ping this often when idle
+)
+
+type PushSample struct {
+	Unit    int        `json:"unit"`
+	Channel int        `json:"channel"`
+	Time    int64      `json:"time"`
+	Value   float64    `json:"value"`
+	Quality ek.Quality `json:"quality"`
+	StdDev  *float64   `json:"stddev,omitempty"` //Slow samples only, as stddev of /json/slow
+	Gap     bool       `json:"gap,omitempty"`
+	Raw     bool       `json:"raw,omitempty"`
+	Slow    bool       `json:"-"`
+}
+
+//Unit and channel. Channel -1 is all channels of unit.
+type Subscription struct {
+	Unit    int
+	Channel int
+}
+
+type pushClient struct {
+	subs    []Subscription //nil is everything
+	raw     bool
+	slow    bool
+	tf      timeFormat //Only tz is used, times are always epoch
+	c       chan PushSample
+	dropped uint64
+}
+
+//Client for the channels, raw, resolution and tz parameters of r
+func newPushClient(r *http.Request, del []*DelphinReceiver) (*pushClient, error) {
+	subs, err := parseSubscriptions(r.FormValue("channels"), del)
+	if err != nil {
+		return nil, err
+	}
+	c := &pushClient{subs: subs, raw: r.FormValue("raw") == "1", c: make(chan PushSample, PUSH_QUEUE)}
+	switch r.FormValue("resolution") {
+	case "", "fast":
+	case "slow":
+		c.slow = true
+	default:
+		return nil, fmt.Errorf("unknown resolution %q, want fast or slow", r.FormValue("resolution"))
+	}
+	if c.raw && c.slow {
+		return nil, fmt.Errorf("raw=1 and resolution=slow can not be combined")
+	}
+	if c.tf, err = timeFormatParam(r); err != nil {
+		return nil, err
+	}
+	if c.tf.rfc3339 {
+		return nil, fmt.Errorf("push times are epoch milliseconds, format=rfc3339 is not supported")
+	}
+	return c, nil
+}
+
+func (c *pushClient) wants(s *PushSample) bool {
+	if s.Raw != c.raw || s.Slow != c.slow {
+		return false
+	}
+	if c.subs == nil {
+		return true
+	}
+	for _, sub := range c.subs {
+		if sub.Unit == s.Unit && (sub.Channel < 0 || sub.Channel == s.Channel) {
+			return true
+		}
+	}
+	return false
+}
+
+//Fans samples out to push clients
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*pushClient]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*pushClient]bool)}
+}
+
+var hub = NewHub()
+
+func (h *Hub) subscribe(c *pushClient) {
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+}
+
+func (h *Hub) unsubscribe(c *pushClient, who string) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	if c.dropped > 0 {
+		log.Printf("Push client %s lost %d samples\n", who, c.dropped)
+	}
+}
+
+//Send sample to interested clients. Never blocks.
+func (h *Hub) Publish(s PushSample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if !c.wants(&s) {
+			continue
+		}
+		cs := s
+		if c.tf.loc != nil {
+			cs.Time = c.tf.stamp(time.Unix(0, s.Time*int64(time.Millisecond))).(int64)
+		}
+		select {
+		case c.c <- cs:
+		default:
+			c.dropped++
+		}
+	}
+}
+
+//Hook for DelphinReceiver.SampleHook publishing samples from unit
+func (h *Hub) hook(unit int) func(uint8, ek.ChannelData, bool) {
+	return func(ch uint8, cd ek.ChannelData, filtered bool) {
+		h.Publish(PushSample{
+			Unit:    unit,
+			Channel: int(ch),
+			Time:    cd.Timestamp.UnixNano() / int64(time.Millisecond),
+			Value:   cd.Value,
+			Quality: cd.Quality,
+			Gap:     cd.Gap,
+			Raw:     !filtered,
+		})
+	}
+}
+
+//Publish the slow average of unit channel ch and its standard deviation
+func (h *Hub) PublishSlow(unit, ch int, avg ek.ChannelData, stddev float64) {
+	h.Publish(PushSample{
+		Unit:    unit,
+		Channel: ch,
+		Time:    avg.Timestamp.UnixNano() / int64(time.Millisecond),
+		Value:   avg.Value,
+		Quality: avg.Quality,
+		StdDev:  &stddev,
+		Gap:     avg.Gap,
+		Slow:    true,
+	})
+}
+
+//Parse channels parameter. nil for all.
+func parseSubscriptions(s string, del []*DelphinReceiver) ([]Subscription, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var subs []Subscription
+	for _, f := range strings.Split(s, ",") {
+		uc := strings.SplitN(strings.TrimSpace(f), ":", 2)
+		if len(uc) != 2 {
+			return nil, fmt.Errorf("bad channel %q, want unit:channel", f)
+		}
+		unit, err := strconv.Atoi(uc[0])
+		if err != nil || unit < 0 || unit >= len(del) {
+			return nil, fmt.Errorf("no unit %q", uc[0])
+		}
+		ch := -1
+		if uc[1] != "*" {
+			ch, err = strconv.Atoi(uc[1])
+			if err != nil || ch < 0 || ch >= del[unit].Profile.Channels {
+				return nil, fmt.Errorf("no channel %q on unit %d", uc[1], unit)
+			}
+		}
+		subs = append(subs, Subscription{unit, ch})
+	}
+	return subs, nil
+}
+
+func sseHandler(del []*DelphinReceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		c, err := newPushClient(r, del)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hub.subscribe(c)
+		defer hub.unsubscribe(c, r.RemoteAddr)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		flusher.Flush()
+		enc := json.NewEncoder(w)
+		keepalive := time.NewTicker(PUSH_KEEPALIVE)
+		defer keepalive.Stop()
+		for {
+			select {
+			case s := <-c.c:
+				for {
+					//Encode adds the newline, one more ends the event
+					fmt.Fprint(w, "data: ")
+					if err := enc.Encode(s); err != nil {
+						return
+					}
+					fmt.Fprint(w, "\n")
+					if len(c.c) == 0 {
+						break
+					}
+					s = <-c.c
+				}
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func wsHandler(del []*DelphinReceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := newPushClient(r, del)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			log.Printf("Push client %s: %s\n", r.RemoteAddr, err)
+			return
+		}
+		defer ws.Close()
+		hub.subscribe(c)
+		defer hub.unsubscribe(c, r.RemoteAddr)
+		done := make(chan error, 1)
+		go func() { done <- ws.readLoop() }()
+		keepalive := time.NewTicker(PUSH_KEEPALIVE)
+		defer keepalive.Stop()
+		for {
+			select {
+			case s := <-c.c:
+				for {
+					b, _ := json.Marshal(s)
+					if err := ws.WriteText(b); err != nil {
+						return
+					}
+					if len(c.c) == 0 {
+						break
+					}
+					s = <-c.c
+				}
+			case <-keepalive.C:
+				ws.writeFrame(WS_PING, nil)
+			case <-done:
+				return
+			}
+			if err := ws.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Full rate samples from ValueBufferRaw, the last RAW_BUFFER_SIZE values of
+// a channel (25 seconds at 100Hz), before the FIR filter.
+//
+//	GET /api/v1/units/{u}/channels/{c}/raw?from=&to=&since=&window=&word=1
+//
+// from, to, since, format and tz are as for samples in api.go. window is a
+// duration (5s, 500ms) back from to, or from the newest sample. word=1 adds
+// the sample word as received from the unit and the signed ADC counts in it,
+// the ValueBits wide value sign extended.
+
+package main
+
+import (
+	"container/ring"
+	"net/http"
+	"time"
+)
+
+type apiRaw struct {
+	Unit    apiUnit         `json:"unit"`
+	Channel apiChannel      `json:"channel"`
+	Columns []string        `json:"columns"`
+	Samples [][]interface{} `json:"samples"`
+	Next    string          `json:"next"` //Cursor for since
+}
+
+//Raw values in r between from and to (nil is open), oldest first
+func rawRange(r *ring.Ring, from, to *time.Time) []RawChannelData {
+	var out []RawChannelData
+	if to != nil {
+		end := to.Truncate(time.Millisecond).Add(time.Millisecond - 1)
+		to = &end
+	}
+	e := r
+	for i := 0; i < RAW_BUFFER_SIZE && e != nil && e.Value != nil; i++ {
+		cd := e.Value.(RawChannelData)
+		if from != nil && cd.Timestamp.Before(*from) {
+			break
+		}
+		if to == nil || !cd.Timestamp.After(*to) {
+			out = append(out, cd)
+		}
+		e = e.Prev()
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+func (a *apiServer) raw(w http.ResponseWriter, r *http.Request, u, c int) {
+	_, to, since, lower, err := rangeParams(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	tf, err := timeFormatParam(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	var window time.Duration
+	if s := r.FormValue("window"); s != "" {
+		if window, err = time.ParseDuration(s); err != nil || window <= 0 {
+			apiError(w, http.StatusBadRequest, "bad window %q, want a duration like 5s", s)
+			return
+		}
+	}
+	word := r.FormValue("word") == "1"
+	d := a.del[u]
+	res := apiRaw{
+		Unit:    a.unit(u),
+		Channel: a.channel(u, c),
+		Columns: []string{"time", "value", "quality", "gap"},
+		Samples: [][]interface{}{},
+	}
+	if word {
+		res.Columns = append(res.Columns, "word", "counts")
+	}
+	points := rawRange(d.ValueBufferRaw[c], lower, to)
+	if window > 0 && len(points) > 0 {
+		start := points[len(points)-1].Timestamp.Add(-window)
+		if to != nil {
+			start = to.Add(-window)
+		}
+		i := len(points)
+		for i > 0 && points[i-1].Timestamp.After(start) {
+			i--
+		}
+		points = points[i:]
+	}
+	var newest time.Time
+	for _, cd := range points {
+		sample := []interface{}{tf.stamp(cd.Timestamp), cd.Value, cd.Quality, cd.Gap}
+		if word {
+			sample = append(sample, cd.Word, d.Profile.RawValue(cd.Word)>>(32-d.Profile.ValueBits))
+		}
+		res.Samples = append(res.Samples, sample)
+		newest = cd.Timestamp
+	}
+	res.Next = nextCursor(newest, since)
+	apiJSON(w, res)
+}
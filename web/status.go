@@ -0,0 +1,129 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Acquisition health for operations. /api/status lists every unit and
+// channel, so a feed that is down shows without reading web.log.
+
+package main
+
+import (
+	"delphin/ek"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type ClockStatus struct {
+	Synced bool    `json:"synced"`
+	Offset float64 `json:"offset"` //Milliseconds, arrival of last sample minus its unit clock time
+	Rate   float64 `json:"rate"`   //Unit counter rate, Hz
+	RTT    float64 `json:"rtt"`    //Milliseconds, last sync
+	Uptime float64 `json:"uptime"` //Seconds since unit power on
+}
+
+type ChannelStatus struct {
+	Channel    int          `json:"channel"`
+	LastSample time.Time    `json:"last_sample"`
+	Age        float64      `json:"age"` //Seconds since last sample. -1 if none has arrived
+	Condition  ek.Condition `json:"condition"`
+	Value      *float64     `json:"value"` //Last filtered value, mV. null if none
+	Quality    ek.Quality   `json:"quality"`
+	Gaps       uint64       `json:"gaps"`
+	Missing    uint64       `json:"missing"`
+}
+
+type UnitStatus struct {
+	Unit        int             `json:"unit"`
+	Address     string          `json:"address"`
+	Connected   bool            `json:"connected"`
+	Profile     string          `json:"profile"`
+	Model       string          `json:"model"`
+	Serial      string          `json:"serial"`
+	Firmware    string          `json:"firmware"`
+	Article     string          `json:"article"`
+	MAC         string          `json:"mac"`
+	LastPacket  time.Time       `json:"last_packet"`
+	PacketAge   float64         `json:"packet_age"` //Seconds since last frame. -1 if none has arrived
+	Packets     uint64          `json:"packets"`
+	Samples     uint64          `json:"samples"`
+	PacketRate  float64         `json:"packet_rate"` //Per second
+	SampleRate  float64         `json:"sample_rate"` //Per second
+	Reconnects  int             `json:"reconnects"`
+	Clock       ClockStatus     `json:"clock"`
+	Calibration string          `json:"calibration"` //Date of factory adjustment in use. Empty if there is none
+	Channels    []ChannelStatus `json:"channels"`
+}
+
+func secondsSince(now, t time.Time) float64 {
+	if t.IsZero() {
+		return -1
+	}
+	return now.Sub(t).Seconds()
+}
+
+func unitStatus(unit int, d *DelphinReceiver, now time.Time) UnitStatus {
+	stats := d.Stats.Snapshot()
+	s := UnitStatus{
+		Unit:       unit,
+		Address:    d.addr,
+		Connected:  d.connected,
+		Profile:    d.Profile.Name,
+		Model:      d.UnitInfo.Model,
+		Serial:     d.UnitInfo.Serial,
+		Firmware:   d.UnitInfo.Firmware,
+		Article:    d.UnitInfo.Article,
+		LastPacket: stats.LastPacket,
+		PacketAge:  secondsSince(now, stats.LastPacket),
+		Packets:    stats.Packets,
+		Samples:    stats.Samples,
+		PacketRate: stats.PacketRate,
+		SampleRate: stats.SampleRate,
+		Reconnects: stats.Reconnects,
+	}
+	if d.UnitInfo.MAC != nil {
+		s.MAC = d.UnitInfo.MAC.String()
+	}
+	if d.Clock.Synced() {
+		s.Clock = ClockStatus{
+			Synced: true,
+			Offset: stats.ClockOffset.Seconds() * 1000,
+			Rate:   d.Clock.Rate(),
+			RTT:    d.Clock.RTT().Seconds() * 1000,
+			Uptime: d.Clock.Uptime().Seconds(),
+		}
+	}
+	if c := d.Calibration; c != nil {
+		s.Calibration = c.Adjustment.Date
+	}
+	gaps := d.Gaps.Counters()
+	for _, h := range d.Watchdog.Status(now) {
+		cs := ChannelStatus{
+			Channel:    h.Channel,
+			LastSample: h.LastSample,
+			Age:        secondsSince(now, h.LastSample),
+			Condition:  h.Condition,
+			Gaps:       gaps[h.Channel].Gaps,
+			Missing:    gaps[h.Channel].Missing,
+		}
+		if r := d.ValueBuffer[h.Channel]; r != nil && r.Value != nil {
+			cd := r.Value.(ek.ChannelData)
+			cs.Value = &cd.Value
+			cs.Quality = cd.Quality | h.Condition.Quality() //Watchdog decides staleness by arrival time
+		}
+		s.Channels = append(s.Channels, cs)
+	}
+	return s
+}
+
+func statusHandler(del []*DelphinReceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		units := make([]UnitStatus, len(del))
+		for i, d := range del {
+			units[i] = unitStatus(i, d, now)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"time": now, "units": units})
+	}
+}
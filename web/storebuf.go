@@ -8,6 +8,7 @@ package main
 
 import (
 	"container/ring"
+	"delphin/ek"
 	"encoding/gob"
 	"fmt"
 	"log"
@@ -17,7 +18,7 @@ import (
 //Functions for saving and loading ring buffers. Really slow and hacky.
 
 func SaveRingBuffer(buf []*ring.Ring, prefix string) {
-	for i := 0; i < 31; i++ {
+	for i := 0; i < len(buf); i++ {
 		fh, err := os.OpenFile(fmt.Sprintf("data/%s%d.bin", prefix, i), os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
 			panic(err)
@@ -33,7 +34,7 @@ func SaveRingBuffer(buf []*ring.Ring, prefix string) {
 }
 
 func LoadRingBuffer(buf []*ring.Ring, prefix string) {
-	for i := 0; i < 31; i++ {
+	for i := 0; i < len(buf); i++ {
 		fh, err := os.Open(fmt.Sprintf("data/%s%d.bin", prefix, i))
 		if err != nil {
 			log.Printf("%s", err)
@@ -42,8 +43,8 @@ func LoadRingBuffer(buf []*ring.Ring, prefix string) {
 		e := buf[i]
 		en := gob.NewDecoder(fh)
 		x := 0
-		var cd ChannelData
 		for x = 0; x < SLOW_BUFFER_SIZE; x++ {
+			var cd ek.ChannelData //Fresh each time, gob leaves zero valued fields (Gap) untouched
 			err = en.Decode(&cd)
 			if err != nil {
 				log.Printf("%s", err)
@@ -7,6 +7,7 @@ package main
 import (
 	"container/ring"
 	"database/sql"
+	"delphin/ek"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	influx "github.com/influxdb/influxdb/client"
@@ -21,16 +22,16 @@ func InfluxCollector(buf []*ring.Ring, unit int) {
 	for {
 		<-t
 		series := []*influx.Series{}
-		for i := 0; i < 31; i++ {
+		for i := 0; i < len(buf); i++ {
 			if buf[i] == nil || buf[i].Value == nil {
 				continue
 			}
 			points := [][]interface{}{
-				{buf[i].Value.(ChannelData).Timestamp.UnixNano() / 1000000, buf[i].Value.(ChannelData).Value},
+				{buf[i].Value.(ek.ChannelData).Timestamp.UnixNano() / 1000000, buf[i].Value.(ek.ChannelData).Value, buf[i].Value.(ek.ChannelData).QualityAt(time.Now()).String()},
 			}
 			s := &influx.Series{
 				Name:    fmt.Sprintf("d%02dc%02d", unit, i),
-				Columns: []string{"time", "value"},
+				Columns: []string{"time", "value", "quality"},
 				Points:  points}
 			series = append(series, s)
 		}
@@ -41,13 +42,28 @@ func InfluxCollector(buf []*ring.Ring, unit int) {
 
 }
 
+//Add the quality column to tables from before quality flags. Old rows get 0, good.
+func migrateQuality(db *sql.DB) error {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'fast' AND COLUMN_NAME = 'quality'").Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	log.Printf("Adding quality column to table fast")
+	_, err = db.Exec("ALTER TABLE fast ADD COLUMN quality TINYINT UNSIGNED NOT NULL DEFAULT 0")
+	return err
+}
+
 func DatabaseCollector(buf []*ring.Ring, unit int) {
 	db, err := sql.Open("mysql", "vmr:vmr@tcp(192.168.0.13:3306)/ovnsvolt")
 	if err != nil {
 		panic(err)
 	}
 
-	stmtIns, err := db.Prepare("INSERT INTO fast (time,value,type,ch,unit) VALUES(?,?,?,?,?)")
+	if err = migrateQuality(db); err != nil {
+		panic(err)
+	}
+	stmtIns, err := db.Prepare("INSERT INTO fast (time,value,type,ch,unit,quality) VALUES(?,?,?,?,?,?)")
 	if err != nil {
 		panic(err)
 	}
@@ -55,15 +71,15 @@ func DatabaseCollector(buf []*ring.Ring, unit int) {
 	c := time.Tick(10 * time.Minute)
 	for {
 		now := <-c
-		for i := 0; i < 31; i++ {
+		for i := 0; i < len(buf); i++ {
 			e := buf[i]
-			var max, min, avg, last ChannelData
+			var max, min, avg, last ek.ChannelData
 			min.Value = 10000
 			max.Value = -10000
 			x := 0
 			for x = 0; x < SLOW_BUFFER_SIZE && e.Value != nil; x++ {
-				cd := e.Value.(ChannelData)
-				if buf[i].Value.(ChannelData).Timestamp.Sub(cd.Timestamp) > (10 * time.Minute) {
+				cd := e.Value.(ek.ChannelData)
+				if buf[i].Value.(ek.ChannelData).Timestamp.Sub(cd.Timestamp) > (10 * time.Minute) {
 					break
 				}
 				if cd.Value < min.Value {
@@ -77,13 +93,15 @@ func DatabaseCollector(buf []*ring.Ring, unit int) {
 					last = cd
 				}
 				avg.Value = avg.Value + cd.Value
+				avg.Quality |= cd.Quality
 				e = e.Prev()
 			}
-			stmtIns.Exec(min.Timestamp, min.Value, 1, i, unit)
-			stmtIns.Exec(max.Timestamp, max.Value, 2, i, unit)
-			stmtIns.Exec(avg.Timestamp, float64(avg.Value)/float64(x), 3, i, unit)
-			stmtIns.Exec(last.Timestamp, last.Value, 4, i, unit)
+			stmtIns.Exec(min.Timestamp, min.Value, 1, i, unit, min.Quality)
+			stmtIns.Exec(max.Timestamp, max.Value, 2, i, unit, max.Quality)
+			stmtIns.Exec(avg.Timestamp, float64(avg.Value)/float64(x), 3, i, unit, avg.Quality)
+			stmtIns.Exec(last.Timestamp, last.Value, 4, i, unit, last.QualityAt(now))
 		}
+		dbWriteDuration.Observe(time.Now().Sub(now).Seconds())
 		log.Printf("Saved values to db in %v", time.Now().Sub(now))
 	}
 }
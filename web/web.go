@@ -9,6 +9,7 @@ package main
 import (
 	"compress/gzip"
 	"container/ring"
+	"delphin/ek"
 	"encoding/json"
 	"fmt"
 	"github.com/nsf/termbox-go"
@@ -25,6 +26,7 @@ import (
 const (
 	STD_DEV_RED      = 30
 	SLOW_BUFFER_SIZE = 20000
+	SLOW_INTERVAL    = 10 * time.Second //Slow buffer and standard deviation update
 )
 
 type gzipResponseWriter struct {
@@ -68,34 +70,76 @@ func doNr(r *ring.Ring, n int, f func(interface{})) int {
 	return i
 }
 
-func httpserver(del []*DelphinReceiver, slow_buffer [][]*ring.Ring, std_dev [][]*ring.Ring, std_dev_m [][]*ring.Ring) {
+//Append [time, value] to newest first series, [time, value, quality] if
+//quality is set. A value with samples missing before it is followed by
+//[time, null] so charts break the line there.
+func appendPoint(data []interface{}, cd ek.ChannelData, ts interface{}, v interface{}, quality bool) []interface{} {
+	if quality {
+		q := cd.Quality
+		if len(data) == 0 {
+			q = cd.QualityAt(time.Now())
+		}
+		data = append(data, []interface{}{ts, v, q})
+	} else {
+		data = append(data, []interface{}{ts, v})
+	}
+	if cd.Gap {
+		data = append(data, []interface{}{ts, nil})
+	}
+	return data
+}
+
+//cd is after since, or since is nil
+func newer(cd ek.ChannelData, since *time.Time) bool {
+	return since == nil || cd.Timestamp.After(*since)
+}
+
+//Up to n values of r newer than since, newest first
+func newestFirst(r *ring.Ring, n int, since *time.Time) []ek.ChannelData {
+	var out []ek.ChannelData
+	e := r
+	for i := 0; i < n && e.Value != nil && newer(e.Value.(ek.ChannelData), since); i++ {
+		out = append(out, e.Value.(ek.ChannelData))
+		e = e.Prev()
+	}
+	return out
+}
+
+func httpserver(del []*DelphinReceiver, slow_buffer [][]*ring.Ring, std_dev [][]*ring.Ring, std_dev_m [][]*ring.Ring, names ChannelNames) {
 	
-	active := make([][]bool, 5)
+	active := make([][]bool, len(del))
 	
-	for di, _ := range del {
-		active[di] = make([]bool, 31)
+	for di, d := range del {
+		active[di] = make([]bool, d.Profile.Channels)
 	}
 
 	//Calculate x sec average
 	//Calculate standard deviation every 10 seconds
 	go func() {
-		t := time.NewTicker(10000 * time.Millisecond)
+		t := time.NewTicker(SLOW_INTERVAL)
 		for {
 
 			for di, d := range del {
 				cnoise := float64(10000)
 				active_channels := 0
-				for i := 0; i < 31; i++ {
+				fresh := make([]bool, d.Profile.Channels) //New average this time
+				for i := 0; i < d.Profile.Channels; i++ {
 					avg := float64(0)
-					num := doNr(d.ValueBuffer[i], STD_DEV_RED, func(e interface{}) { avg += e.(ChannelData).Value })
+					gap := false
+					quality := ek.QUALITY_GOOD
+					num := doNr(d.ValueBuffer[i], STD_DEV_RED, func(e interface{}) {
+						avg += e.(ek.ChannelData).Value
+						gap = gap || e.(ek.ChannelData).Gap
+						quality |= e.(ek.ChannelData).Quality
+					})
 					if num > 0 {
 						avg = avg / float64(num)
-						last := d.ValueBuffer[i].Value.(ChannelData).Timestamp
+						last := d.ValueBuffer[i].Value.(ek.ChannelData).Timestamp
 						std := float64(0)
-						num2 := doNr(d.ValueBuffer[i], num, func(e interface{}) { std += math.Pow(e.(ChannelData).Value-avg, 2) })
+						num2 := doNr(d.ValueBuffer[i], num, func(e interface{}) { std += math.Pow(e.(ek.ChannelData).Value-avg, 2) })
 						std = math.Sqrt(std / float64(num2))
 						std_dev[di][i] = std_dev[di][i].Next()
-						std_dev[di][i].Value = ChannelData{last, std}
+						std_dev[di][i].Value = ek.ChannelData{Timestamp: last, Value: std, Gap: gap, Quality: quality}
 						//For Common noise77
 						if std < cnoise && active[di][i] && !(i == 30 && di == 1) && (avg > 1000) {
 							cnoise = std
@@ -103,16 +147,20 @@ func httpserver(del []*DelphinReceiver, slow_buffer [][]*ring.Ring, std_dev [][]
 						}
 						active_channels++
 						slow_buffer[di][i] = slow_buffer[di][i].Next()
-						slow_buffer[di][i].Value = ChannelData{last, avg}
+						slow_buffer[di][i].Value = ek.ChannelData{Timestamp: last, Value: avg, Gap: gap, Quality: quality}
+						fresh[i] = true
 					}
 
 				}
 				//cnoise = cnoise / float64(active_channels)
-				for i := 0; i < 31; i++ {
+				for i := 0; i < d.Profile.Channels; i++ {
 					if std_dev[di][i].Value != nil {
 						std_dev_m[di][i] = std_dev_m[di][i].Next()
-						l := std_dev[di][i].Value.(ChannelData)
-						std_dev_m[di][i].Value = ChannelData{l.Timestamp, l.Value - cnoise}
+						l := std_dev[di][i].Value.(ek.ChannelData)
+						std_dev_m[di][i].Value = ek.ChannelData{Timestamp: l.Timestamp, Value: l.Value - cnoise, Gap: l.Gap, Quality: l.Quality}
+					}
+					if fresh[i] {
+						hub.PublishSlow(di, i, slow_buffer[di][i].Value.(ek.ChannelData), std_dev_m[di][i].Value.(ek.ChannelData).Value)
 					}
 				}
 			}
@@ -121,17 +169,47 @@ func httpserver(del []*DelphinReceiver, slow_buffer [][]*ring.Ring, std_dev [][]
 	}()
 
 	http.Handle("/", http.FileServer(http.Dir("./static")))
-	http.HandleFunc("/json/slow", gzHandler(func(w http.ResponseWriter, r *http.Request) {
-		_, zone_offset := time.Now().Zone() //Javascript is dumb
+	http.HandleFunc("/api/status", instrument("/api/status", gzHandler(statusHandler(del))))
+	api := &apiServer{del, slow_buffer, std_dev_m, active, names}
+	http.HandleFunc(API_PREFIX, instrument(API_PREFIX, withETag(gzHandler(api.ServeHTTP))))
+	http.HandleFunc("/export/", instrument("/export/", gzHandler(api.export)))
+	http.HandleFunc("/push/sse", sseHandler(del))
+	http.HandleFunc("/push/ws", wsHandler(del))
+	http.HandleFunc("/metrics", instrument("/metrics", gzHandler(metricsHandler(del, std_dev))))
+	//since (api.go) returns only newer values, next is the cursor for the
+	//following request. /json/fast is a plain array, it has the cursor in X-Next.
+	//Times are UTC, format and tz as for api.go. The pages ask for tz=local.
+	//max_points and downsample (downsample.go) reduce values and stddev.
+	http.HandleFunc("/json/slow", instrument("/json/slow", withETag(gzHandler(func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		enc := json.NewEncoder(w)
 		requested_values := 100
 		unit := 0 // Default delphin unit is 0
+		quality := r.FormValue("quality") != ""
+		since, err := timeParam(r, "since")
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": true, "error_msg": err.Error(), "error_num": 442})
+			return
+		}
+		tf, err := timeFormatParam(r)
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": true, "error_msg": err.Error(), "error_num": 443})
+			return
+		}
+		max_points, method, err := downsampleParams(r)
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": true, "error_msg": err.Error(), "error_num": 444})
+			return
+		}
 		if ch, err := strconv.Atoi(r.FormValue("channel")); err == nil {
 			if unit, err = strconv.Atoi(r.FormValue("unit")); err != nil {
 				unit = 0
 			}
-			if ! active[unit][ch] {
+			if unit < 0 || unit >= len(del) || ch < 0 || ch >= del[unit].Profile.Channels {
+				enc.Encode(map[string]interface{}{"error": true, "error_msg": "No such unit or channel", "error_num": 441})
+				return
+			}
+			if !active[unit][ch] {
 				log.Printf("Set %d/%d Active", unit, ch)
 				active[unit][ch] = true
 			}
@@ -141,43 +219,65 @@ func httpserver(del []*DelphinReceiver, slow_buffer [][]*ring.Ring, std_dev [][]
 			if requested_values > SLOW_BUFFER_SIZE {
 				requested_values = SLOW_BUFFER_SIZE
 			}
-			data := make([]interface{}, 0, requested_values)
-			e := slow_buffer[unit][ch]
-			for i := 0; i < requested_values && e.Value != nil; i++ {
-				data = append(data, []interface{}{int64(e.Value.(ChannelData).Timestamp.UnixNano()/1000/1000) + int64(zone_offset*1000), int64(e.Value.(ChannelData).Value + 0.5)})
-				e = e.Prev()
+			values := newestFirst(slow_buffer[unit][ch], requested_values, since)
+			var newest time.Time
+			if len(values) > 0 {
+				newest = values[0].Timestamp
 			}
-			stddev := make([]interface{}, 0, requested_values)
-			e = std_dev_m[unit][ch]
-			for i := 0; i < requested_values && e.Value != nil; i++ {
-				stddev = append(stddev, []interface{}{int64(e.Value.(ChannelData).Timestamp.UnixNano()/1000/1000) + int64(zone_offset*1000), float64(int64(e.Value.(ChannelData).Value*1000)) / 1000})
-				e = e.Prev()
+			data := make([]interface{}, 0, len(values))
+			for _, cd := range downsample(values, max_points, method) {
+				data = appendPoint(data, cd, tf.stamp(cd.Timestamp), int64(cd.Value+0.5), quality)
 			}
-			enc.Encode(map[string]interface{}{"values": data, "stddev": stddev, "error": false})
+			values = newestFirst(std_dev_m[unit][ch], requested_values, since)
+			stddev := make([]interface{}, 0, len(values))
+			for _, cd := range downsample(values, max_points, method) {
+				stddev = appendPoint(stddev, cd, tf.stamp(cd.Timestamp), float64(int64(cd.Value*1000))/1000, quality)
+			}
+			enc.Encode(map[string]interface{}{"values": data, "stddev": stddev, "next": nextCursor(newest, since), "error": false})
 			data = nil
 		} else {
 			enc.Encode(map[string]interface{}{"error": true, "error_msg": "No channel defined", "error_num": 440})
 		}
-	}))
-	http.HandleFunc("/json/fast", gzHandler(func(w http.ResponseWriter, r *http.Request) {
-		_, zone_offset := time.Now().Zone() //Javascript is dumb
+	}))))
+	http.HandleFunc("/json/fast", instrument("/json/fast", withETag(gzHandler(func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		unit := 0
+		quality := r.FormValue("quality") != ""
 		enc := json.NewEncoder(w)
+		since, err := timeParam(r, "since")
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": true, "error_msg": err.Error(), "error_num": 442})
+			return
+		}
+		tf, err := timeFormatParam(r)
+		if err != nil {
+			enc.Encode(map[string]interface{}{"error": true, "error_msg": err.Error(), "error_num": 443})
+			return
+		}
 		if ch, err := strconv.Atoi(r.FormValue("channel")); err == nil {
 			if unit, err = strconv.Atoi(r.FormValue("unit")); err != nil {
 				unit = 0
 			}
+			if unit < 0 || unit >= len(del) || ch < 0 || ch >= del[unit].Profile.Channels {
+				enc.Encode(map[string]interface{}{"error": true, "error_msg": "No such unit or channel", "error_num": 441})
+				return
+			}
 			e := del[unit].ValueBuffer[ch]
 			data := make([]interface{}, 0, 100)
-			for i := 0; i < 100 && e.Value != nil; i++ {
-				data = append(data, []interface{}{int64(e.Value.(ChannelData).Timestamp.UnixNano()/1000/1000) + int64(zone_offset*1000), e.Value.(ChannelData).Value})
+			var newest time.Time
+			for i := 0; i < 100 && e.Value != nil && newer(e.Value.(ek.ChannelData), since); i++ {
+				if i == 0 {
+					newest = e.Value.(ek.ChannelData).Timestamp
+				}
+				data = appendPoint(data, e.Value.(ek.ChannelData), tf.stamp(e.Value.(ek.ChannelData).Timestamp), e.Value.(ek.ChannelData).Value, quality)
 				e = e.Prev()
 			}
+			//Plain array, the cursor goes in a header
+			w.Header().Set("X-Next", nextCursor(newest, since))
 			enc.Encode(data)
 			data = nil
 		}
-	}))
+	}))))
 
 	err := http.ListenAndServe(":12345", nil)
 	if err != nil {
@@ -201,7 +301,7 @@ func printfAt(x int, y int, format string, a ...interface{}) {
 }
 
 func main() {
-	file, err := os.OpenFile("web.log", os.O_RDWR|os.O_APPEND, 0666)
+	file, err := os.OpenFile("web.log", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
 		panic(err)
 	}
@@ -210,6 +310,8 @@ func main() {
 
 	units := 2
 	unit_address := [2]string{"192.168.251.252:1034", "192.168.251.253:1034"}
+	unit_open_circuit := [2]string{"", ""} //Open circuit thresholds, "channel:mV,..." see ParseOpenCircuit
+	unit_flatline := [2]string{"", ""}     //Flatline thresholds, "channel:mV**2,..." see ParseFlatline
 
 	slow_buffer := make([][]*ring.Ring, units)
 	std_dev := make([][]*ring.Ring, units)
@@ -217,12 +319,26 @@ func main() {
 	del := make([]*DelphinReceiver, units)
 
 	for d := 0; d < units; d++ { // Initilize buffers and start collectors
-		del[d] = NewDelphinReceiver(unit_address[d])
+		del[d] = NewDelphinReceiverProfile(unit_address[d], ProbeProfile(unit_address[d]))
+		channels := del[d].Profile.Channels
+		open_circuit, err := ek.ParseOpenCircuit(unit_open_circuit[d], channels)
+		if err != nil {
+			panic(err)
+		}
+		del[d].OpenCircuit = open_circuit
+		flatline, err := ek.ParseFlatline(unit_flatline[d], channels, del[d].Profile.LSB()*del[d].Profile.LSB())
+		if err != nil {
+			panic(err)
+		}
+		del[d].Watchdog.SetFlatline(flatline)
+		del[d].CalibStore = ek.NewCalibrationStore("data/calib")
+		del[d].SiteCalStore = ek.NewSiteCalibrationStore(ek.SITECAL_FILE)
+		del[d].SampleHook = hub.hook(d)
 
-		slow_buffer[d] = make([]*ring.Ring, 31)
-		std_dev[d] = make([]*ring.Ring, 31)
-		std_dev_m[d] = make([]*ring.Ring, 31)
-		for i := 0; i < 31; i++ {
+		slow_buffer[d] = make([]*ring.Ring, channels)
+		std_dev[d] = make([]*ring.Ring, channels)
+		std_dev_m[d] = make([]*ring.Ring, channels)
+		for i := 0; i < channels; i++ {
 			slow_buffer[d][i] = ring.New(SLOW_BUFFER_SIZE)
 			std_dev[d][i] = ring.New(SLOW_BUFFER_SIZE)
 			std_dev_m[d][i] = ring.New(SLOW_BUFFER_SIZE)
@@ -243,10 +359,20 @@ func main() {
 				SaveRingBuffer(std_dev[ds], fmt.Sprintf("std_dev%d", ds))
 				SaveRingBuffer(std_dev_m[ds], fmt.Sprintf("std_dev_m%d", ds))
 				log.Printf("Saved buffers in %v", time.Now().Sub(now))
+				for ch, c := range del[ds].Gaps.Counters() {
+					if c.Gaps+c.Duplicates+c.OutOfOrder+c.Restarts > 0 {
+						log.Printf("Unit %d channel %d: %d samples, %d gaps (%d missing), %d duplicates, %d out of order, %d restarts",
+							ds, ch, c.Samples, c.Gaps, c.Missing, c.Duplicates, c.OutOfOrder, c.Restarts)
+					}
+				}
 			}
 		}
 	}()
-	go httpserver(del, slow_buffer, std_dev, std_dev_m)
+	names, err := LoadChannelNames("data/channels.json")
+	if err != nil {
+		log.Printf("Could not load channel names: %s\n", err)
+	}
+	go httpserver(del, slow_buffer, std_dev, std_dev_m, names)
 	time.Sleep(5 * time.Second)
 	/*	err = termbox.Init()
 		if err != nil {
@@ -0,0 +1,175 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Minimal server side WebSocket (RFC 6455). Enough to push text messages
+// and notice when the browser goes away: no extensions, no fragmented
+// messages from the client, client data other than control frames is
+// discarded.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	WS_GUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	WS_TEXT        = 0x1
+	WS_CLOSE       = 0x8
+	WS_PING        = 0x9
+	WS_PONG        = 0xa
+	WS_MAX_CONTROL = 125 //Largest control frame payload
+)
+
+var errNotWebSocket = errors.New("not a websocket handshake")
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex //Held while writing
+	w    *bufio.Writer
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+//Complete the opening handshake and take over the connection. On error
+//the reply has been sent or the connection is gone, the caller must not
+//write to w.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" || !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, errNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, errNotWebSocket
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		err := errors.New("websocket: connection can not be hijacked")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	//Nothing can be written to w after this, failed or not
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + WS_GUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader, w: rw.Writer}, nil
+}
+
+//Queue frame. Frames are sent on Flush.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	head := []byte{0x80 | opcode, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	n := 2
+	switch l := len(payload); {
+	case l < 126:
+		head[1] = byte(l)
+	case l < 1<<16:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(l))
+		n = 4
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(l))
+		n = 10
+	}
+	c.w.Write(head[:n])
+	_, err := c.w.Write(payload)
+	return err
+}
+
+func (c *wsConn) WriteText(msg []byte) error {
+	return c.writeFrame(WS_TEXT, msg)
+}
+
+func (c *wsConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Flush()
+}
+
+func (c *wsConn) Close() error {
+	c.writeFrame(WS_CLOSE, nil)
+	c.Flush()
+	return c.conn.Close()
+}
+
+//Read frames until the client closes or the connection fails. Answers pings.
+func (c *wsConn) readLoop() error {
+	var head [2]byte
+	for {
+		if _, err := io.ReadFull(c.r, head[:]); err != nil {
+			return err
+		}
+		opcode := head[0] & 0x0f
+		l := uint64(head[1] & 0x7f)
+		switch l {
+		case 126:
+			var b [2]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return err
+			}
+			l = uint64(binary.BigEndian.Uint16(b[:]))
+		case 127:
+			var b [8]byte
+			if _, err := io.ReadFull(c.r, b[:]); err != nil {
+				return err
+			}
+			l = binary.BigEndian.Uint64(b[:])
+		}
+		var mask [4]byte
+		if head[1]&0x80 != 0 {
+			if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+				return err
+			}
+		}
+		if opcode < WS_CLOSE {
+			if _, err := io.CopyN(ioutil.Discard, c.r, int64(l)); err != nil {
+				return err
+			}
+			continue
+		}
+		if l > WS_MAX_CONTROL {
+			return errors.New("websocket: control frame too large")
+		}
+		payload := make([]byte, l)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case WS_CLOSE:
+			return io.EOF
+		case WS_PING:
+			c.writeFrame(WS_PONG, payload)
+			c.Flush()
+		}
+	}
+}
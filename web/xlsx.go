@@ -0,0 +1,128 @@
+// Copyright 2015 Thomas Jager <mail@jager.no> All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Minimal XLSX (Office Open XML spreadsheet) writer. One sheet, a bold
+// header row that stays in view, numbers, text and times. Enough for
+// Excel and LibreOffice to open exports without an import dialog.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	XLSX_MAIN = "http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+	XLSX_RELS = "http://schemas.openxmlformats.org/package/2006/relationships"
+	XLSX_DOC  = "http://schemas.openxmlformats.org/officeDocument/2006/relationships"
+
+	XLSX_STYLE_TIME   = 1 //cellXfs index in styles.xml
+	XLSX_STYLE_HEADER = 2
+)
+
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", `<Relationships xmlns="` + XLSX_RELS + `">` +
+		`<Relationship Id="rId1" Type="` + XLSX_DOC + `/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", `<workbook xmlns="` + XLSX_MAIN + `" xmlns:r="` + XLSX_DOC + `">` +
+		`<sheets><sheet name="Export" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="` + XLSX_RELS + `">` +
+		`<Relationship Id="rId1" Type="` + XLSX_DOC + `/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`<Relationship Id="rId2" Type="` + XLSX_DOC + `/styles" Target="styles.xml"/>` +
+		`</Relationships>`},
+	{"xl/styles.xml", `<styleSheet xmlns="` + XLSX_MAIN + `">` +
+		`<numFmts count="1"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss.000"/></numFmts>` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+		`</styleSheet>`},
+}
+
+//Column letters for column i, 0 is A
+func xlsxColumn(i int) string {
+	s := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		s = string(rune('A'+(i-1)%26)) + s
+	}
+	return s
+}
+
+//Days since 1899-12-30 of the wall clock of t, Excel has no time zones
+func xlsxTime(t time.Time) float64 {
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	return float64(wall.Sub(time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC))) / float64(24*time.Hour)
+}
+
+func xlsxCell(w *bufio.Writer, ref string, v interface{}, style int) {
+	s := ""
+	if style != 0 {
+		s = fmt.Sprintf(` s="%d"`, style)
+	}
+	switch v := v.(type) {
+	case float64:
+		fmt.Fprintf(w, `<c r="%s"%s><v>%s</v></c>`, ref, s, strconv.FormatFloat(v, 'g', -1, 64))
+	case time.Time:
+		fmt.Fprintf(w, `<c r="%s" s="%d"><v>%s</v></c>`, ref, XLSX_STYLE_TIME, strconv.FormatFloat(xlsxTime(v), 'f', -1, 64))
+	case string:
+		fmt.Fprintf(w, `<c r="%s"%s t="inlineStr"><is><t>`, ref, s)
+		xml.EscapeText(w, []byte(v))
+		w.WriteString(`</t></is></c>`)
+	}
+}
+
+//Write header and rows as a workbook. Cells are nil (empty), float64,
+//string or time.Time.
+func writeXLSX(out io.Writer, header []string, rows [][]interface{}) error {
+	z := zip.NewWriter(out)
+	for _, p := range xlsxParts {
+		f, err := z.Create(p.name)
+		if err != nil {
+			return err
+		}
+		io.WriteString(f, xml.Header+p.content)
+	}
+	f, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(xml.Header + `<worksheet xmlns="` + XLSX_MAIN + `">`)
+	w.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	w.WriteString(`<cols><col min="1" max="1" width="24" customWidth="1"/></cols><sheetData>`)
+	w.WriteString(`<row r="1">`)
+	for i, h := range header {
+		xlsxCell(w, xlsxColumn(i)+"1", h, XLSX_STYLE_HEADER)
+	}
+	w.WriteString(`</row>`)
+	for r, row := range rows {
+		fmt.Fprintf(w, `<row r="%d">`, r+2)
+		for i, v := range row {
+			xlsxCell(w, xlsxColumn(i)+strconv.Itoa(r+2), v, 0)
+		}
+		w.WriteString(`</row>`)
+	}
+	w.WriteString(`</sheetData></worksheet>`)
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	return z.Close()
+}